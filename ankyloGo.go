@@ -1,37 +1,83 @@
 package ankylogo
 
 import (
+	"context"
 	"log"
 	"net/http"
+	"sort"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
-// ScoreReader returns the current risk score for an IP
+// ScoreReader returns the current risk score for an actor
 type ScoreReader interface {
-	GetScore(ip string) int64
+	GetScore(actor string) int64
+}
+
+// CooldownReader can optionally be implemented by a ScoreReader to tell how long
+// until an actor's score decays below score. It is used for Retry-After on risk denials.
+type CooldownReader interface {
+	Cooldown(actor string, score int64) time.Duration
+}
+
+// CorrelationReader can optionally be implemented by a ScoreReader to hold back enforcement
+// until several independent signals agree. Scores of actors it reports as uncorrelated
+// neither deny nor tighten limits
+type CorrelationReader interface {
+	Correlated(actor string) bool
 }
 
 type Config struct {
+	// identity — decides which actor a request is counted against, defaults to IPKey()
+	KeyExtractor KeyExtractor
 	// sliding wzndow
-	Window int64
+	Window time.Duration
 	Limit  int
 	// token bucket
 	Capacity          int
 	TokensPerInterval int
 	RefillRate        time.Duration
+	// BucketAlgorithm enforces the bucket above with a token bucket (default) or with GCRA,
+	// which refills evenly and keeps a single timestamp per actor
+	BucketAlgorithm BucketAlgorithm
+	// Dimensions, when set, replace the limits above with several independent ones
+	// (e.g. per IP and per API key) that must all pass for a request to be allowed
+	Dimensions []Dimension
+	// Cost is how many tokens / window slots one request consumes (0 = 1).
+	// Set it on an endpoint policy to make expensive endpoints drain budgets faster
+	Cost int
+	// ResponseCost runs after the handler and returns extra cost to debit from the same
+	// actor's budgets, e.g. CostOnStatus(5, 401, 403) so failed logins drain faster
+	ResponseCost func(c *gin.Context) int
+	// Username runs after the handler and returns the username the request tried to sign in
+	// as, if any, e.g. from a form field. It is hashed into the event so the risk engine can
+	// tell credential stuffing from brute force
+	Username func(c *gin.Context) string
+	// FailMode decides what happens when the store errors (e.g. Redis is down):
+	// FailOpen (default) serves the request, FailClosed denies it with 503
+	FailMode FailMode
 	// kafka
 	EventPublisher EventPublisher
 	// risk scoring — if ScoreReader is set, the middleware adjusts limits based on risk
-	// DenyScore is the score at which all requests are denied (0 = disabled)
+	// DenyScore is the score in points (1.0 = 100) at which all requests are denied (0 = disabled)
 	ScoreReader ScoreReader
 	DenyScore   int64
 }
 
+// FailMode is the policy for requests whose limits can't be verified
+type FailMode int
+
+const (
+	// FailOpen lets requests through when the store is unavailable
+	FailOpen FailMode = iota
+	// FailClosed denies requests with 503 when the store is unavailable
+	FailClosed
+)
+
 func DefaultConfig() Config {
 	return Config{
-		Window:            60,
+		Window:            time.Minute,
 		Limit:             100,
 		Capacity:          10,
 		TokensPerInterval: 1,
@@ -39,137 +85,359 @@ func DefaultConfig() Config {
 	}
 }
 
-// RateLimiterMiddleware returns a gin middleware that rate limits per IP
-// using both a sliding window and a token bucket.
-func RateLimiterMiddleware(store RateLimiterStore, config Config, endpointPolicies ...map[string]Config) gin.HandlerFunc {
-	if config.Window == 0 && config.Limit == 0 && config.Capacity == 0 {
+// CostOnStatus returns a Config.ResponseCost hook that charges extra
+// whenever the handler responded with one of the given status codes
+func CostOnStatus(extra int, statuses ...int) func(c *gin.Context) int {
+	return func(c *gin.Context) int {
+		status := c.Writer.Status()
+		for _, s := range statuses {
+			if status == s {
+				return extra
+			}
+		}
+		return 0
+	}
+}
+
+// RateLimiterMiddleware returns a gin middleware that rate limits per actor
+// (IP by default, see Config.KeyExtractor) using both a sliding window and a token bucket.
+// Stores written against the older RateLimiterStore interface can be passed through AdaptStore.
+//
+// endpointPolicies map routes to the Config they use instead, see Policy.Route for the syntax.
+// Among equally specific routes the first in sorted order wins.
+// A PolicyRegistry with PolicyMiddleware adds priorities and shared counters for route groups
+func RateLimiterMiddleware(store DecisionStore, config Config, endpointPolicies ...map[string]Config) gin.HandlerFunc {
+	var policies []Policy
+	for _, endpoints := range endpointPolicies {
+		// in route order, map order would break ties between equally specific routes at random
+		routes := make([]string, 0, len(endpoints))
+		for route := range endpoints {
+			routes = append(routes, route)
+		}
+		sort.Strings(routes)
+		for _, route := range routes {
+			policies = append(policies, Policy{Route: route, Config: endpoints[route]})
+		}
+	}
+	return PolicyMiddleware(store, NewPolicyRegistry(config, policies...))
+}
+
+// limiterContextKey is where a middleware leaves its limiter for the Limit middlewares behind it
+const limiterContextKey = "ankylogo.limiter"
+
+// deniedContextKey marks a request denied by a Limit behind the middleware that let it through
+const deniedContextKey = "ankylogo.denied"
+
+// limiter enforces the limits of a request against a store. config holds the settings
+// shared by every route: identity, risk scoring and events
+type limiter struct {
+	store      DecisionStore
+	config     Config
+	extractKey KeyExtractor
+	// stores that check all limits of a request before charging any (e.g. MemoryStore, RedisStore)
+	batch    BatchStore
+	canBatch bool
+	canGCRA  bool
+}
+
+// newLimiter returns a limiter for config, warning about anything in configs it can't enforce as asked
+func newLimiter(store DecisionStore, config Config, configs ...Config) *limiter {
+	configs = append([]Config{config}, configs...)
+	configured := false
+	for _, d := range allDimensions(configs...) {
+		configured = configured || d.enabled()
+	}
+	if !configured {
 		log.Println("warning: no rate limiting configured, all requests will pass through")
 	}
 
-	return func(c *gin.Context) {
-		ip := c.ClientIP()
+	l := &limiter{store: store, config: config, extractKey: config.KeyExtractor}
+	if l.extractKey == nil {
+		l.extractKey = IPKey()
+	}
+	l.batch, l.canBatch = store.(BatchStore)
+	_, l.canGCRA = store.(GCRAStore)
+	if !l.canGCRA && usesGCRA(configs...) {
+		log.Println("warning: store does not support GCRA, the token bucket is used instead")
+	}
+	if usesSubMillisecond(configs...) {
+		// Window used to be in seconds, Window: 60 now means 60ns
+		log.Println("warning: a Window or RefillRate is below 1ms, they are time.Duration values: use 60 * time.Second rather than 60")
+	}
+	return l
+}
+
+// handle limits the request with activeConfig and runs the rest of the chain if it is allowed.
+// A non-empty namespace gives the request's counters their own keys, apart from the default's.
+// nested is set for a Limit behind another middleware, which publishes the ALLOWED event
+func (l *limiter) handle(c *gin.Context, activeConfig Config, namespace string, nested bool) {
+	ctx := c.Request.Context()
+	ip := c.ClientIP()
+	actor, ok := l.extractKey(c)
+	if !ok {
+		actor = ip
+	}
 
-		// Build key from method + path: "POST /login", "GET /search"
-		key := c.Request.Method + " " + c.FullPath()
+	// Build key from method + path: "POST /login", "GET /search"
+	key := c.Request.Method + " " + c.FullPath()
 
-		// Check if this endpoint has a specific policy
-		activeConfig := config // default fallback
-		var policies map[string]Config
-		if len(endpointPolicies) > 0 {
-			policies = endpointPolicies[0]
+	dimensions := activeConfig.dimensions()
+	cost := activeConfig.Cost
+	if cost < 1 {
+		cost = 1
+	}
+
+	// Dynamic enforcement: adjust limits based on risk score
+	if l.config.ScoreReader != nil && l.config.DenyScore > 0 && correlated(l.config.ScoreReader, actor) {
+		riskScore := l.config.ScoreReader.GetScore(actor)
+		if riskScore >= l.config.DenyScore {
+			if l.config.EventPublisher != nil {
+				l.config.EventPublisher.Publish(RateLimitEvent{
+					IP:         ip,
+					Actor:      actor,
+					Endpoint:   key,
+					Path:       c.Request.URL.Path,
+					Action:     "DENIED_RISK",
+					Timestamp:  time.Now().UnixNano(),
+					UserAgent:  c.Request.UserAgent(),
+					StatusCode: http.StatusForbidden,
+				})
+			}
+			if cooldown, ok := l.config.ScoreReader.(CooldownReader); ok {
+				setRetryAfter(c, cooldown.Cooldown(actor, l.config.DenyScore))
+			}
+			c.Set(deniedContextKey, true)
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error": "Access temporarily restricted due to suspicious activity.",
+			})
+			return
 		}
-		if policies != nil {
-			if policy, exists := policies[key]; exists {
-				activeConfig = policy
+		if riskScore > 0 {
+			// Proportionally reduce limits: higher score = tighter limits
+			factor := 1.0 - (float64(riskScore) / float64(l.config.DenyScore))
+			if factor < 0.1 {
+				factor = 0.1
+			}
+			scaled := make([]Dimension, len(dimensions))
+			for i, d := range dimensions {
+				scaled[i] = d.scaled(factor)
 			}
+			dimensions = scaled
 		}
+	}
 
-		// Build the store key: include endpoint when per-endpoint policies are active
-		// so different endpoints get separate rate limit counters
-		storeKey := ip
-		if policies != nil {
-			if _, exists := policies[key]; exists {
-				storeKey = ip + ":" + key
+	// the limits this request is checked against and the dimension each belongs to,
+	// kept so a post-response cost can be debited from the same counters
+	var limits []LimitCheck
+	var limitDimensions []Dimension
+
+	// the budget closest to running out is the one reported in the RateLimit headers
+	var tightest *Quota
+	track := func(q Quota) {
+		if tightest == nil || q.Remaining < tightest.Remaining {
+			tightest = &q
+		}
+	}
+
+	// enforce applies one store decision and reports whether the request may continue.
+	// Denials and fail-closed store errors abort the request
+	enforce := func(decision Decision, dimension Dimension) bool {
+		if decision.Err != nil {
+			if activeConfig.FailMode == FailClosed {
+				denyStoreUnavailable(c, l.config, ip, actor, key, dimension.Name)
+				return false
 			}
+			// fail open: state can't be verified, let the request through
+			return true
+		}
+		track(decision.Quota)
+		if decision.Allowed {
+			return true
 		}
 
-		// Dynamic enforcement: adjust limits based on risk score
-		if config.ScoreReader != nil && config.DenyScore > 0 {
-			riskScore := config.ScoreReader.GetScore(ip)
-			if riskScore >= config.DenyScore {
-				if config.EventPublisher != nil {
-					config.EventPublisher.Publish(RateLimitEvent{
-						IP:         ip,
-						Endpoint:   key,
-						Action:     "DENIED_RISK",
-						Timestamp:  time.Now().UnixNano(),
-						UserAgent:  c.Request.UserAgent(),
-						StatusCode: http.StatusForbidden,
-					})
-				}
-				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
-					"error": "Access temporarily restricted due to suspicious activity.",
-				})
-				return
+		action := "DENIED_WINDOW"
+		if decision.Algorithm == AlgorithmTokenBucket || decision.Algorithm == AlgorithmGCRA {
+			action = "DENIED_BUCKET"
+		}
+		if l.config.EventPublisher != nil {
+			l.config.EventPublisher.Publish(RateLimitEvent{
+				IP:         ip,
+				Actor:      actor,
+				Endpoint:   key,
+				Path:       c.Request.URL.Path,
+				Action:     action,
+				Dimension:  dimension.Name,
+				Timestamp:  time.Now().UnixNano(),
+				UserAgent:  c.Request.UserAgent(),
+				StatusCode: http.StatusTooManyRequests,
+			})
+		}
+
+		setRateLimitHeaders(c, decision.Quota)
+		setRetryAfter(c, decision.retryAfter())
+
+		c.Set(deniedContextKey, true)
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+			"error": "Too many requests. Please try again later.",
+		})
+		return false
+	}
+
+	for _, dimension := range dimensions {
+		// Resolve the identity this dimension counts against,
+		// dimensions without an extractor share the request's actor
+		dimensionKey := actor
+		if dimension.KeyExtractor != nil {
+			extracted, found := dimension.KeyExtractor(c)
+			if !found {
+				continue
 			}
-			if riskScore > 0 {
-				// Proportionally reduce limits: higher score = tighter limits
-				factor := 1.0 - (float64(riskScore) / float64(config.DenyScore))
-				if factor < 0.1 {
-					factor = 0.1
-				}
-				// Only reduce limits that were originally configured (> 0)
-				// to avoid re-enabling algorithms the user intentionally disabled
-				if activeConfig.Limit > 0 {
-					activeConfig.Limit = int(float64(activeConfig.Limit) * factor)
-					if activeConfig.Limit < 1 {
-						activeConfig.Limit = 1
-					}
-				}
-				if activeConfig.Capacity > 0 {
-					activeConfig.Capacity = int(float64(activeConfig.Capacity) * factor)
-					if activeConfig.Capacity < 1 {
-						activeConfig.Capacity = 1
-					}
-				}
+			dimensionKey = extracted
+		}
+
+		// Build the store key: namespace by dimension so an IP and an API key never
+		// share counters, and include the policy's namespace so endpoints with their own
+		// policy get separate rate limit counters
+		storeKey := dimensionKey
+		if dimension.Name != "" {
+			storeKey = dimension.Name + ":" + storeKey
+		}
+		if namespace != "" {
+			storeKey = storeKey + ":" + namespace
+		}
+
+		if dimension.Window > 0 && dimension.Limit > 0 {
+			limits = append(limits, LimitCheck{Key: storeKey, Algorithm: AlgorithmSlidingWindow,
+				Window: dimension.Window, Limit: dimension.Limit, Cost: cost})
+			limitDimensions = append(limitDimensions, dimension)
+		}
+		if dimension.Capacity > 0 {
+			algorithm := AlgorithmTokenBucket
+			if l.canGCRA && dimension.BucketAlgorithm == BucketGCRA {
+				algorithm = AlgorithmGCRA
 			}
+			limits = append(limits, LimitCheck{Key: storeKey, Algorithm: algorithm, Capacity: dimension.Capacity,
+				TokensPerInterval: dimension.TokensPerInterval, RefillRate: dimension.RefillRate, Cost: cost})
+			limitDimensions = append(limitDimensions, dimension)
 		}
+	}
 
-		if activeConfig.Window > 0 && activeConfig.Limit > 0 {
-			var allowedWindow bool = store.AllowedSlidingWindow(storeKey, activeConfig.Window, activeConfig.Limit)
+	// every limit is checked before any is charged, so a request denied by one dimension
+	// doesn't use up the others. Stores that can't do that are checked one limit at a time
+	var decisions []Decision
+	if l.canBatch {
+		decisions = l.batch.CheckAll(ctx, limits)
+	} else {
+		decisions = checkEach(ctx, l.store, limits)
+	}
+	for i, decision := range decisions {
+		if !enforce(decision, limitDimensions[i]) {
+			return
+		}
+	}
 
-			if !allowedWindow {
-				if config.EventPublisher != nil {
-					config.EventPublisher.Publish(RateLimitEvent{
-						IP:         ip,
-						Endpoint:   key,
-						Action:     "DENIED_WINDOW",
-						Timestamp:  time.Now().UnixNano(),
-						UserAgent:  c.Request.UserAgent(),
-						StatusCode: http.StatusTooManyRequests,
-					})
-				}
+	// headers have to be set before the handler writes the response
+	if tightest != nil {
+		setRateLimitHeaders(c, *tightest)
+	}
 
-				c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
-					"error": "Too many requests. Please try again later.",
-				})
-				return
+	c.Next()
+	// a Limit further down the chain denied the request
+	if c.GetBool(deniedContextKey) {
+		return
+	}
+
+	// Post-hoc cost: charge extra based on the response, e.g. failed authentications.
+	// The response is already sent, so a store error here only loses the penalty.
+	// A client hanging up right after its response must not skip the charge
+	if activeConfig.ResponseCost != nil {
+		if extra := activeConfig.ResponseCost(c); extra > 0 {
+			ctx := context.WithoutCancel(ctx)
+			for _, limit := range limits {
+				limit.Cost = extra
+				chargeLimit(ctx, l.store, limit)
 			}
 		}
+	}
 
-		if activeConfig.Capacity > 0 {
-			var allowedBucket bool = store.AllowedTokenBucket(storeKey, activeConfig.Capacity, activeConfig.TokensPerInterval, activeConfig.RefillRate)
+	// behind another middleware, that one publishes the event for the whole chain
+	if !nested && l.config.EventPublisher != nil {
+		username := ""
+		if activeConfig.Username != nil {
+			if name := activeConfig.Username(c); name != "" {
+				username = hashIdentity(name)
+			}
+		}
+		l.config.EventPublisher.Publish(RateLimitEvent{
+			IP:         ip,
+			Actor:      actor,
+			Endpoint:   key,
+			Path:       c.Request.URL.Path,
+			Action:     "ALLOWED",
+			Timestamp:  time.Now().UnixNano(),
+			UserAgent:  c.Request.UserAgent(),
+			StatusCode: c.Writer.Status(),
+			Username:   username,
+		})
+	}
+}
 
-			if !allowedBucket {
-				if config.EventPublisher != nil {
-					config.EventPublisher.Publish(RateLimitEvent{
-						IP:         ip,
-						Endpoint:   key,
-						Action:     "DENIED_BUCKET",
-						Timestamp:  time.Now().UnixNano(),
-						UserAgent:  c.Request.UserAgent(),
-						StatusCode: http.StatusTooManyRequests,
-					})
-				}
+// correlated reports whether the reader's score of actor may be enforced
+func correlated(reader ScoreReader, actor string) bool {
+	gate, ok := reader.(CorrelationReader)
+	return !ok || gate.Correlated(actor)
+}
 
-				c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
-					"error": "Too many requests. Please try again later.",
-				})
-				return
+// usesGCRA reports whether any of the configs asks for GCRA
+func usesGCRA(configs ...Config) bool {
+	for _, d := range allDimensions(configs...) {
+		if d.BucketAlgorithm == BucketGCRA {
+			return true
+		}
+	}
+	return false
+}
+
+// usesSubMillisecond reports whether any of the configs has a Window or RefillRate
+// above zero but below a millisecond, most likely a count of seconds
+func usesSubMillisecond(configs ...Config) bool {
+	for _, d := range allDimensions(configs...) {
+		for _, duration := range []time.Duration{d.Window, d.RefillRate} {
+			if duration > 0 && duration < time.Millisecond {
+				return true
 			}
 		}
+	}
+	return false
+}
 
-		c.Next()
+// allDimensions lists the dimensions of every config
+func allDimensions(configs ...Config) []Dimension {
+	var dimensions []Dimension
+	for _, config := range configs {
+		dimensions = append(dimensions, config.dimensions()...)
+	}
+	return dimensions
+}
 
-		if config.EventPublisher != nil {
-			config.EventPublisher.Publish(RateLimitEvent{
-				IP:         ip,
-				Endpoint:   key,
-				Action:     "ALLOWED",
-				Timestamp:  time.Now().UnixNano(),
-				UserAgent:  c.Request.UserAgent(),
-				StatusCode: c.Writer.Status(),
-			})
-		}
+// denyStoreUnavailable rejects a request on a fail-closed endpoint
+// when the store couldn't tell whether it is within its limits
+func denyStoreUnavailable(c *gin.Context, config Config, ip, actor, endpoint, dimension string) {
+	if config.EventPublisher != nil {
+		config.EventPublisher.Publish(RateLimitEvent{
+			IP:         ip,
+			Actor:      actor,
+			Endpoint:   endpoint,
+			Path:       c.Request.URL.Path,
+			Action:     "DENIED_STORE_UNAVAILABLE",
+			Dimension:  dimension,
+			Timestamp:  time.Now().UnixNano(),
+			UserAgent:  c.Request.UserAgent(),
+			StatusCode: http.StatusServiceUnavailable,
+		})
 	}
+	c.Set(deniedContextKey, true)
+	c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+		"error": "Service temporarily unavailable. Please try again later.",
+	})
 }
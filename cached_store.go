@@ -0,0 +1,414 @@
+package ankylogo
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+var (
+	_ DecisionStore    = (*CachedStore)(nil)
+	_ BatchStore       = (*CachedStore)(nil)
+	_ GCRAStore        = (*CachedStore)(nil)
+	_ RateLimiterStore = (*CachedStore)(nil)
+)
+
+// CachedStore is an L1 cache in front of another DecisionStore (usually a RedisStore).
+//
+// After the backing store answers for a key, the remaining budget is kept locally for ttl.
+// While that budget stays above comfortFraction of the capacity/limit, requests are allowed
+// from memory and their cost is queued up, then written to the backing store with the next
+// call that does go through. Near-limit decisions always go to the backing store.
+// Concurrent misses for the same key are collapsed into one backing call with singleflight.
+// A cached budget is only used for the capacity or limit it was read under, so a limit
+// lowered by risk scoring goes to the backing store straight away.
+//
+// CheckAll, which the middleware uses, serves a request from memory only if all of its limits
+// can be; otherwise they go to the backing store together, see CachedStore.CheckAll.
+type CachedStore struct {
+	backing         DecisionStore
+	maxEntries      int
+	ttl             time.Duration
+	comfortFraction float64
+
+	mu      sync.Mutex
+	lru     *list.List // front = most recently used
+	entries map[string]*list.Element
+	group   singleflight.Group
+}
+
+// cacheEntry is the locally known budget for one key of one algorithm
+type cacheEntry struct {
+	key       string
+	limit     int    // capacity or limit the budget was read under
+	quota     Quota  // budget reported by the backing store minus local consumption
+	algorithm string // Decision.Algorithm of the backing store
+	pending   int    // cost allowed locally that the backing store hasn't seen yet
+	expires   time.Time
+	flush     func(ctx context.Context, pending int) error // charges pending cost to the backing store
+}
+
+// NewCachedStore wraps backing with an LRU of at most maxEntries keys. ttl is how long a budget
+// read from the backing store is trusted (the README suggests 1s) and comfortFraction is the
+// share of capacity that must remain for a request to be served from memory (e.g. 0.2).
+// A legacy RateLimiterStore can be cached by wrapping it with AdaptStore.
+func NewCachedStore(backing DecisionStore, maxEntries int, ttl time.Duration, comfortFraction float64) *CachedStore {
+	return &CachedStore{
+		backing:         backing,
+		maxEntries:      maxEntries,
+		ttl:             ttl,
+		comfortFraction: comfortFraction,
+		lru:             list.New(),
+		entries:         make(map[string]*list.Element),
+	}
+}
+
+func (s *CachedStore) CheckSlidingWindow(ctx context.Context, key string, window time.Duration, limit, cost int) Decision {
+	return s.check(ctx, LimitCheck{Key: key, Algorithm: AlgorithmSlidingWindow, Window: window, Limit: limit, Cost: cost})
+}
+
+func (s *CachedStore) CheckTokenBucket(ctx context.Context, key string, capacity, tokensPerInterval int, refillRate time.Duration, cost int) Decision {
+	return s.check(ctx, LimitCheck{Key: key, Algorithm: AlgorithmTokenBucket, Capacity: capacity, TokensPerInterval: tokensPerInterval, RefillRate: refillRate, Cost: cost})
+}
+
+// CheckGCRA caches GCRA budgets like token buckets. A backing store without GCRA
+// support enforces the token bucket instead, as the middleware would
+func (s *CachedStore) CheckGCRA(ctx context.Context, key string, capacity, tokensPerInterval int, refillRate time.Duration, cost int) Decision {
+	return s.check(ctx, LimitCheck{Key: key, Algorithm: AlgorithmGCRA, Capacity: capacity, TokensPerInterval: tokensPerInterval, RefillRate: refillRate, Cost: cost})
+}
+
+// Charges go straight to the backing store, the local budget is only adjusted
+// so the cache doesn't keep serving from a balance that no longer exists
+func (s *CachedStore) ChargeSlidingWindow(ctx context.Context, key string, window time.Duration, limit, cost int) error {
+	return s.charge(ctx, LimitCheck{Key: key, Algorithm: AlgorithmSlidingWindow, Window: window, Limit: limit, Cost: cost})
+}
+
+func (s *CachedStore) ChargeTokenBucket(ctx context.Context, key string, capacity, tokensPerInterval int, refillRate time.Duration, cost int) error {
+	return s.charge(ctx, LimitCheck{Key: key, Algorithm: AlgorithmTokenBucket, Capacity: capacity, TokensPerInterval: tokensPerInterval, RefillRate: refillRate, Cost: cost})
+}
+
+func (s *CachedStore) ChargeGCRA(ctx context.Context, key string, capacity, tokensPerInterval int, refillRate time.Duration, cost int) error {
+	return s.charge(ctx, LimitCheck{Key: key, Algorithm: AlgorithmGCRA, Capacity: capacity, TokensPerInterval: tokensPerInterval, RefillRate: refillRate, Cost: cost})
+}
+
+// CheckAll serves a request from memory when every one of its limits has a comfortable
+// cached budget. Otherwise the pending local cost is written and all limits go to the backing
+// store together, through its own CheckAll if it is a BatchStore so a request denied by one
+// limit is not charged to the others. Without it the limits are checked one at a time
+func (s *CachedStore) CheckAll(ctx context.Context, limits []LimitCheck) []Decision {
+	limits = s.resolveAlgorithms(limits)
+	if decisions, ok := s.takeAllLocal(limits); ok {
+		return decisions
+	}
+
+	batch, ok := s.backing.(BatchStore)
+	if !ok {
+		return checkEach(ctx, s, limits)
+	}
+
+	decisions := make([]Decision, len(limits))
+	for _, l := range limits {
+		if pending := s.takePending(cacheKey(l)); pending > 0 {
+			if err := s.flushFor(l)(ctx, pending); err != nil {
+				s.store(cacheKey(l), l.limit(), Decision{}, pending, s.flushFor(l))
+				for i := range decisions {
+					decisions[i] = Decision{Algorithm: limits[i].Algorithm, Err: err}
+				}
+				return decisions
+			}
+		}
+	}
+
+	decisions = batch.CheckAll(ctx, limits)
+	for i, d := range decisions {
+		if d.Err == nil {
+			s.store(cacheKey(limits[i]), limits[i].limit(), d, 0, s.flushFor(limits[i]))
+		}
+	}
+	return decisions
+}
+
+// RateLimiterStore methods
+
+func (s *CachedStore) AllowedSlidingWindow(key string, window time.Duration, limit, cost int) (bool, Quota, error) {
+	d := s.CheckSlidingWindow(context.Background(), key, window, limit, cost)
+	return d.Allowed, d.Quota, d.Err
+}
+
+func (s *CachedStore) AllowedTokenBucket(key string, capacity, tokensPerInterval int, refillRate time.Duration, cost int) (bool, Quota, error) {
+	d := s.CheckTokenBucket(context.Background(), key, capacity, tokensPerInterval, refillRate, cost)
+	return d.Allowed, d.Quota, d.Err
+}
+
+func (s *CachedStore) DebitSlidingWindow(key string, window time.Duration, limit, cost int) error {
+	return s.ChargeSlidingWindow(context.Background(), key, window, limit, cost)
+}
+
+func (s *CachedStore) DebitTokenBucket(key string, capacity, tokensPerInterval int, refillRate time.Duration, cost int) error {
+	return s.ChargeTokenBucket(context.Background(), key, capacity, tokensPerInterval, refillRate, cost)
+}
+
+// Flush writes every locally allowed cost to the backing store, call it before shutdown
+// so requests served from the cache are not lost
+func (s *CachedStore) Flush() error {
+	s.mu.Lock()
+	type flushJob struct {
+		flush   func(context.Context, int) error
+		pending int
+	}
+	var jobs []flushJob
+	for _, elem := range s.entries {
+		entry := elem.Value.(*cacheEntry)
+		if entry.pending > 0 {
+			jobs = append(jobs, flushJob{flush: entry.flush, pending: entry.pending})
+			entry.pending = 0
+		}
+	}
+	s.mu.Unlock()
+
+	var firstErr error
+	for _, job := range jobs {
+		if err := job.flush(context.Background(), job.pending); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// check answers a single limit from the cached budget or the backing store
+func (s *CachedStore) check(ctx context.Context, l LimitCheck) Decision {
+	l = s.resolveAlgorithms([]LimitCheck{l})[0]
+	key := cacheKey(l)
+	floor := s.floor(l)
+	if d, ok := s.takeLocal(key, l.limit(), l.Cost, floor); ok {
+		return d
+	}
+
+	check := func(ctx context.Context) Decision {
+		return checkLimit(ctx, s.backing, l)
+	}
+	d := s.resolve(ctx, key, l.limit(), l.Cost, floor, s.flushFor(l), check)
+	if d.Algorithm == "" {
+		d.Algorithm = l.Algorithm
+	}
+	return d
+}
+
+func (s *CachedStore) charge(ctx context.Context, l LimitCheck) error {
+	l = s.resolveAlgorithms([]LimitCheck{l})[0]
+	s.adjustLocal(cacheKey(l), l.Cost)
+	return chargeLimit(ctx, s.backing, l)
+}
+
+// resolveAlgorithms turns GCRA limits into token buckets when the backing store has no GCRA
+// support, so they are cached under the token bucket the backing store enforces instead
+func (s *CachedStore) resolveAlgorithms(limits []LimitCheck) []LimitCheck {
+	if _, ok := s.backing.(GCRAStore); ok {
+		return limits
+	}
+	var resolved []LimitCheck
+	for i, l := range limits {
+		if l.Algorithm != AlgorithmGCRA {
+			continue
+		}
+		if resolved == nil {
+			resolved = append([]LimitCheck(nil), limits...)
+		}
+		resolved[i].Algorithm = AlgorithmTokenBucket
+	}
+	if resolved == nil {
+		return limits
+	}
+	return resolved
+}
+
+// flushFor returns the function charging pending local cost of a limit to the backing store
+func (s *CachedStore) flushFor(l LimitCheck) func(context.Context, int) error {
+	return func(ctx context.Context, pending int) error {
+		l.Cost = pending
+		return chargeLimit(ctx, s.backing, l)
+	}
+}
+
+// floor is the budget that must remain after a request served from memory
+func (s *CachedStore) floor(l LimitCheck) int {
+	return int(float64(l.limit()) * s.comfortFraction)
+}
+
+// cacheKey is the cache entry of a limit, one per algorithm and key
+func cacheKey(l LimitCheck) string {
+	switch l.Algorithm {
+	case AlgorithmGCRA:
+		return "gcra:" + l.Key
+	case AlgorithmTokenBucket:
+		return "bucket:" + l.Key
+	default:
+		return "sliding:" + l.Key
+	}
+}
+
+// takeLocal serves a request from the cached budget if it is fresh, was read under the same
+// limit (risk scoring may have lowered it since) and stays above floor after paying cost
+func (s *CachedStore) takeLocal(cacheKey string, limit, cost, floor int) (Decision, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elem, ok := s.entries[cacheKey]
+	if !ok || !s.servable(elem.Value.(*cacheEntry), limit, cost, floor) {
+		return Decision{}, false
+	}
+	return s.take(elem, cost), true
+}
+
+// takeAllLocal is takeLocal for every limit of a request: all of them are served
+// from memory or none is
+func (s *CachedStore) takeAllLocal(limits []LimitCheck) ([]Decision, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elems := make([]*list.Element, len(limits))
+	for i, l := range limits {
+		elem, ok := s.entries[cacheKey(l)]
+		if !ok || !s.servable(elem.Value.(*cacheEntry), l.limit(), l.Cost, s.floor(l)) {
+			return nil, false
+		}
+		elems[i] = elem
+	}
+	decisions := make([]Decision, len(limits))
+	for i, l := range limits {
+		decisions[i] = s.take(elems[i], l.Cost)
+	}
+	return decisions, true
+}
+
+// servable reports whether entry can pay cost from memory, caller must hold s.mu.
+// A budget read under another limit, or above the current one, is stale
+func (s *CachedStore) servable(entry *cacheEntry, limit, cost, floor int) bool {
+	if entry.limit != limit || entry.quota.Remaining > limit || time.Now().After(entry.expires) {
+		return false
+	}
+	return entry.quota.Remaining-cost > floor
+}
+
+// take pays cost from a cached budget, caller must hold s.mu
+func (s *CachedStore) take(elem *list.Element, cost int) Decision {
+	entry := elem.Value.(*cacheEntry)
+	entry.quota.Remaining -= cost
+	entry.pending += cost
+	s.lru.MoveToFront(elem)
+	return Decision{Allowed: true, Quota: entry.quota, Algorithm: entry.algorithm}
+}
+
+// resolve asks the backing store for a decision. Only one caller per key goes to the
+// backing store at a time, the others wait for it and then retry the cached budget,
+// falling back to their own backing call if the key turned out to be near its limit.
+//
+// The shared call doesn't inherit the first caller's cancellation, one client going away
+// must not fail everyone waiting on the same key. Each caller still stops waiting when
+// its own context is done.
+func (s *CachedStore) resolve(ctx context.Context, cacheKey string, limit, cost, floor int, flush func(context.Context, int) error, check func(context.Context) Decision) Decision {
+	leader := new(bool)
+	shared := s.group.DoChan(cacheKey, func() (interface{}, error) {
+		*leader = true
+		return s.callBacking(context.WithoutCancel(ctx), cacheKey, limit, flush, check), nil
+	})
+
+	var d Decision
+	select {
+	case result := <-shared:
+		d = result.Val.(Decision)
+	case <-ctx.Done():
+		return Decision{Err: ctx.Err()}
+	}
+	if *leader || d.Err != nil {
+		return d
+	}
+
+	// the leader's call only paid for its own request
+	if local, ok := s.takeLocal(cacheKey, limit, cost, floor); ok {
+		return local
+	}
+	return s.callBacking(ctx, cacheKey, limit, flush, check)
+}
+
+// callBacking writes any pending local cost, makes the backing call and caches the new budget
+func (s *CachedStore) callBacking(ctx context.Context, cacheKey string, limit int, flush func(context.Context, int) error, check func(context.Context) Decision) Decision {
+	pending := s.takePending(cacheKey)
+	if pending > 0 {
+		if err := flush(ctx, pending); err != nil {
+			s.store(cacheKey, limit, Decision{}, pending, flush)
+			return Decision{Err: err}
+		}
+	}
+
+	d := check(ctx)
+	if d.Err != nil {
+		return d
+	}
+	s.store(cacheKey, limit, d, 0, flush)
+	return d
+}
+
+// takePending removes and returns the cost a key has accumulated locally
+func (s *CachedStore) takePending(cacheKey string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elem, ok := s.entries[cacheKey]
+	if !ok {
+		return 0
+	}
+	entry := elem.Value.(*cacheEntry)
+	pending := entry.pending
+	entry.pending = 0
+	return pending
+}
+
+// adjustLocal lowers the cached budget of a key after a debit
+func (s *CachedStore) adjustLocal(cacheKey string, cost int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elem, ok := s.entries[cacheKey]; ok {
+		entry := elem.Value.(*cacheEntry)
+		entry.quota.Remaining = max(entry.quota.Remaining-cost, 0)
+	}
+}
+
+// store caches the budget of a fresh decision for a key read under limit, evicting the least
+// recently used key when full. Evicted keys with pending cost are flushed in the background.
+func (s *CachedStore) store(cacheKey string, limit int, d Decision, pending int, flush func(context.Context, int) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expires := time.Now().Add(s.ttl)
+	if elem, ok := s.entries[cacheKey]; ok {
+		entry := elem.Value.(*cacheEntry)
+		entry.quota = d.Quota
+		entry.limit = limit
+		if d.Algorithm != "" {
+			entry.algorithm = d.Algorithm
+		}
+		entry.pending += pending
+		entry.expires = expires
+		entry.flush = flush
+		s.lru.MoveToFront(elem)
+		return
+	}
+
+	entry := &cacheEntry{key: cacheKey, limit: limit, quota: d.Quota, algorithm: d.Algorithm, pending: pending, expires: expires, flush: flush}
+	s.entries[cacheKey] = s.lru.PushFront(entry)
+
+	for s.maxEntries > 0 && s.lru.Len() > s.maxEntries {
+		oldest := s.lru.Back()
+		evicted := oldest.Value.(*cacheEntry)
+		s.lru.Remove(oldest)
+		delete(s.entries, evicted.key)
+		if evicted.pending > 0 {
+			go evicted.flush(context.Background(), evicted.pending)
+		}
+	}
+}
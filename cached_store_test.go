@@ -0,0 +1,241 @@
+package ankylogo
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingStore wraps a MemoryStore and counts how often each method is called,
+// with an optional delay to simulate a Redis roundtrip
+type countingStore struct {
+	*MemoryStore
+	delay        time.Duration
+	allowedCalls atomic.Int64
+	debitCalls   atomic.Int64
+	debited      atomic.Int64
+}
+
+func newCountingStore(delay time.Duration) *countingStore {
+	return &countingStore{MemoryStore: NewMemoryStore(), delay: delay}
+}
+
+func (s *countingStore) CheckTokenBucket(ctx context.Context, key string, capacity, tokensPerInterval int, refillRate time.Duration, cost int) Decision {
+	s.allowedCalls.Add(1)
+	time.Sleep(s.delay)
+	return s.MemoryStore.CheckTokenBucket(ctx, key, capacity, tokensPerInterval, refillRate, cost)
+}
+
+func (s *countingStore) ChargeTokenBucket(ctx context.Context, key string, capacity, tokensPerInterval int, refillRate time.Duration, cost int) error {
+	s.debitCalls.Add(1)
+	s.debited.Add(int64(cost))
+	return s.MemoryStore.ChargeTokenBucket(ctx, key, capacity, tokensPerInterval, refillRate, cost)
+}
+
+/*
+Testing that comfortably allowed requests are served from L1 without losing any cost
+Capacity 100 with a comfort fraction of 0.2: the cache answers locally while more than 20
+tokens remain, then every near-limit request goes to the backing store. Exactly 100 of
+110 requests must pass and most of them must never reach the backing store
+*/
+func TestCachedStoreServesComfortableRequests(t *testing.T) {
+	backing := newCountingStore(0)
+	store := NewCachedStore(backing, 100, time.Minute, 0.2)
+
+	passCount := 0
+	for i := 0; i < 110; i++ {
+		if allowed, _, _ := store.AllowedTokenBucket("10.0.0.1", 100, 0, time.Second, 1); allowed {
+			passCount++
+		}
+	}
+
+	if passCount != 100 {
+		t.Errorf("Cached store should allow exactly the capacity of 100, allowed %d", passCount)
+	}
+	if calls := backing.allowedCalls.Load(); calls > 35 {
+		t.Errorf("Most requests should be served from L1, backing store saw %d calls", calls)
+	}
+	if debited := backing.debited.Load(); debited != 78 {
+		t.Errorf("Locally allowed cost should be flushed to the backing store, flushed %d want 78", debited)
+	}
+}
+
+/*
+Testing that cached budgets expire after the TTL
+With a 50ms TTL the second request is local, the third (after expiry) goes to the backing store
+*/
+func TestCachedStoreTTL(t *testing.T) {
+	backing := newCountingStore(0)
+	store := NewCachedStore(backing, 100, 50*time.Millisecond, 0.2)
+
+	store.AllowedTokenBucket("10.0.0.2", 100, 0, time.Second, 1)
+	store.AllowedTokenBucket("10.0.0.2", 100, 0, time.Second, 1)
+	if calls := backing.allowedCalls.Load(); calls != 1 {
+		t.Errorf("Second request should be served from L1, backing store saw %d calls", calls)
+	}
+
+	time.Sleep(80 * time.Millisecond)
+
+	store.AllowedTokenBucket("10.0.0.2", 100, 0, time.Second, 1)
+	if calls := backing.allowedCalls.Load(); calls != 2 {
+		t.Errorf("Request after TTL should go to the backing store, backing store saw %d calls", calls)
+	}
+}
+
+/*
+Testing singleflight stampede protection
+50 concurrent requests for a cold key must produce a single backing call,
+the rest are served from the budget that call brought back
+*/
+func TestCachedStoreSingleflight(t *testing.T) {
+	backing := newCountingStore(50 * time.Millisecond)
+	store := NewCachedStore(backing, 100, time.Minute, 0.2)
+
+	var wg sync.WaitGroup
+	var passCount atomic.Int64
+	start := make(chan struct{})
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if allowed, _, _ := store.AllowedTokenBucket("10.0.0.3", 1000, 0, time.Second, 1); allowed {
+				passCount.Add(1)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if passCount.Load() != 50 {
+		t.Errorf("All 50 requests should be allowed, allowed %d", passCount.Load())
+	}
+	if calls := backing.allowedCalls.Load(); calls != 1 {
+		t.Errorf("Concurrent misses should collapse into 1 backing call, got %d", calls)
+	}
+}
+
+/*
+Testing the LRU bound: with room for 2 keys, a third key evicts the least recently used one
+and the evicted key's locally allowed cost is still written to the backing store
+*/
+func TestCachedStoreLRUEviction(t *testing.T) {
+	backing := newCountingStore(0)
+	store := NewCachedStore(backing, 2, time.Minute, 0.2)
+
+	// key a: one backing call + 2 local requests pending
+	for i := 0; i < 3; i++ {
+		store.AllowedTokenBucket("a", 100, 0, time.Second, 1)
+	}
+	store.AllowedTokenBucket("b", 100, 0, time.Second, 1)
+	store.AllowedTokenBucket("c", 100, 0, time.Second, 1)
+
+	store.mu.Lock()
+	_, hasA := store.entries["bucket:a"]
+	size := store.lru.Len()
+	store.mu.Unlock()
+	if hasA || size != 2 {
+		t.Errorf("Cache should hold 2 keys with the oldest evicted, has a=%v size=%d", hasA, size)
+	}
+
+	// the flush of an evicted key happens in the background
+	deadline := time.Now().Add(time.Second)
+	for backing.debited.Load() != 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if debited := backing.debited.Load(); debited != 2 {
+		t.Errorf("Evicted key should flush its 2 pending tokens, flushed %d", debited)
+	}
+}
+
+/*
+Testing that one caller giving up doesn't fail the others waiting on the same key
+The first caller's context is canceled while the shared backing call is in flight,
+it returns the cancellation while a second caller still gets its decision
+*/
+func TestCachedStoreLeaderCancel(t *testing.T) {
+	backing := newCountingStore(50 * time.Millisecond)
+	store := NewCachedStore(backing, 100, time.Minute, 0.2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	leaderDone := make(chan Decision)
+	go func() {
+		leaderDone <- store.CheckTokenBucket(ctx, "10.0.0.4", 100, 0, time.Second, 1)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	followerDone := make(chan Decision)
+	go func() {
+		followerDone <- store.CheckTokenBucket(context.Background(), "10.0.0.4", 100, 0, time.Second, 1)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	if d := <-leaderDone; !errors.Is(d.Err, context.Canceled) {
+		t.Errorf("Canceled caller should return context.Canceled, got %v", d.Err)
+	}
+	if d := <-followerDone; d.Err != nil || !d.Allowed {
+		t.Errorf("Waiting caller should still be allowed, got allowed=%v err=%v", d.Allowed, d.Err)
+	}
+}
+
+/*
+Testing that a cached budget is not used once the capacity changes
+After one check at capacity 100 the actor's capacity is lowered to 5 (e.g. by risk scoring):
+the 98 tokens cached under capacity 100 must not be served, only the 5 of the new capacity
+*/
+func TestCachedStoreCapacityChange(t *testing.T) {
+	client := setupRedisClient()
+	if client == nil {
+		t.Skip("Redis not available, skipping test")
+	}
+	defer client.Close()
+	ctx := context.Background()
+	client.Del(ctx, "bucket:{test-cached-capacity}")
+
+	store := NewCachedStore(NewRedisStore(client), 100, time.Minute, 0.2)
+	store.CheckTokenBucket(ctx, "test-cached-capacity", 100, 0, time.Second, 1)
+
+	allowed := 0
+	for i := 0; i < 50; i++ {
+		if store.CheckTokenBucket(ctx, "test-cached-capacity", 5, 0, time.Second, 1).Allowed {
+			allowed++
+		}
+	}
+	if allowed != 5 {
+		t.Errorf("Only the lowered capacity of 5 should be allowed, allowed %d", allowed)
+	}
+
+	// Cleanup
+	client.Del(ctx, "bucket:{test-cached-capacity}")
+}
+
+/*
+Testing CheckAll through the cache
+A window of 100 and a bucket of 1 on different keys over a MemoryStore: the 2nd request
+can't be served from memory and is denied by the bucket in the backing store's CheckAll,
+without taking a slot of the window
+*/
+func TestCachedStoreCheckAll(t *testing.T) {
+	backing := newCountingStore(0)
+	store := NewCachedStore(backing, 100, time.Minute, 0.2)
+	ctx := context.Background()
+	limits := []LimitCheck{
+		{Key: "ip:10.0.0.5", Algorithm: AlgorithmSlidingWindow, Window: time.Minute, Limit: 100, Cost: 1},
+		{Key: "apikey:tenant", Algorithm: AlgorithmTokenBucket, Capacity: 1, RefillRate: time.Minute, Cost: 1},
+	}
+
+	if d := store.CheckAll(ctx, limits); !d[0].Allowed || !d[1].Allowed {
+		t.Fatalf("First request should pass both limits, got %+v", d)
+	}
+	d := store.CheckAll(ctx, limits)
+	if !d[0].Allowed || d[1].Allowed {
+		t.Errorf("Second request should be denied by the bucket only, got %+v", d)
+	}
+	if window := backing.CheckSlidingWindow(ctx, "ip:10.0.0.5", time.Minute, 100, 1); window.Remaining != 98 {
+		t.Errorf("Window should have been charged for the first request only, %d slots left want 98", window.Remaining)
+	}
+}
@@ -0,0 +1,116 @@
+package ankylogo
+
+import "time"
+
+// CorrelationPolicy holds an actor's score below the engine's threshold until several
+// detectors agree: one noisy detector alone never gets an actor denied. The engine reports
+// such actors as uncorrelated (CorrelationReader), so the middleware does not tighten their
+// limits either
+type CorrelationPolicy struct {
+	// MinSignals is the number of detectors that must fire within Window (0 = 2)
+	MinSignals int
+	// Window is how close together the detectors must fire (0 = 10 minutes)
+	Window time.Duration
+	// FireLevel is the signal, from 0 to 1, at which a detector counts as fired (0 = 0.5)
+	FireLevel float64
+	// Ceiling is the highest score, from 0.0 to 1.0, while too few detectors fired
+	// (0 = one point below the engine's threshold, which is then never reached)
+	Ceiling float64
+}
+
+// Signal is a detector that fired for an actor, kept to explain the actor's score
+type Signal struct {
+	Detector string
+	// Strength is the strongest signal of the detector within the correlation window
+	Strength float64
+	// At is when the detector last fired
+	At time.Time
+}
+
+// correlation returns the engine's policy with its defaults filled in.
+// Signals are recorded with the defaults even without a policy
+func (r *RiskEngine) correlation() CorrelationPolicy {
+	var policy CorrelationPolicy
+	if r.Correlation != nil {
+		policy = *r.Correlation
+	}
+	if policy.MinSignals <= 0 {
+		policy.MinSignals = 2
+	}
+	if policy.Window <= 0 {
+		policy.Window = 10 * time.Minute
+	}
+	if policy.FireLevel <= 0 {
+		policy.FireLevel = 0.5
+	}
+	if policy.Ceiling <= 0 {
+		policy.Ceiling = max(float64(r.threshold-1), 0) / 100
+	}
+	return policy
+}
+
+// recordSignals notes the detectors firing at now and returns how many fired within the window
+func (policy CorrelationPolicy) recordSignals(fired []Signal, detectors []WeightedDetector, signals []float64, now time.Time) int {
+	count := 0
+	for i, signal := range signals {
+		if signal >= policy.FireLevel {
+			if now.Sub(fired[i].At) > policy.Window {
+				fired[i].Strength = 0
+			}
+			fired[i] = Signal{
+				Detector: detectors[i].Detector.Name(),
+				Strength: max(fired[i].Strength, signal),
+				At:       later(fired[i].At, now),
+			}
+		}
+		if !fired[i].At.IsZero() && now.Sub(fired[i].At) <= policy.Window {
+			count++
+		}
+	}
+	return count
+}
+
+// Correlated reports whether enough detectors fired for actor within the correlation window
+// for its score to be enforced, always true without a Correlation policy
+func (r *RiskEngine) Correlated(actor string) bool {
+	if r.Correlation == nil {
+		return true
+	}
+	val, ok := r.ipScores.Load(actor)
+	if !ok {
+		return false
+	}
+	riskScore := val.(*RiskScore)
+	riskScore.mu.Lock()
+	defer riskScore.mu.Unlock()
+	return riskScore.correlated
+}
+
+// Explain returns the detectors that fired for actor within the correlation window
+// before its latest event, in the order of Detectors
+func (r *RiskEngine) Explain(actor string) []Signal {
+	val, ok := r.ipScores.Load(actor)
+	if !ok {
+		return nil
+	}
+	riskScore := val.(*RiskScore)
+	riskScore.mu.Lock()
+	defer riskScore.mu.Unlock()
+
+	window := r.correlation().Window
+	var signals []Signal
+	for _, signal := range riskScore.fired {
+		if !signal.At.IsZero() && riskScore.lastEvent.Sub(signal.At) <= window {
+			signals = append(signals, signal)
+		}
+	}
+	return signals
+}
+
+// later returns the later of a and b
+func later(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
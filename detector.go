@@ -0,0 +1,146 @@
+package ankylogo
+
+import (
+	"sync"
+	"time"
+)
+
+// Detector looks for one pattern of abuse in the events of each actor
+type Detector interface {
+	// Name identifies the signal, e.g. "failed_auth"
+	Name() string
+	// Observe records an event of actor and returns how strongly the actor now shows
+	// the pattern, from 0 (not at all) to 1
+	Observe(actor string, event RateLimitEvent) float64
+}
+
+// WeightedDetector is a Detector and its share of the combined risk score
+type WeightedDetector struct {
+	Detector Detector
+	Weight   float64
+}
+
+// DefaultDetectors returns the detectors of the risk engine with their default settings.
+// The geo detector resolves IPs with locator and is left out when it is nil, the score is
+// then the weighted average of the other four and can still reach 1.0
+func DefaultDetectors(locator Locator) []WeightedDetector {
+	detectors := []WeightedDetector{
+		{Detector: &FailedAuthDetector{}, Weight: 0.35},
+		{Detector: &GeoVelocityDetector{Locator: locator}, Weight: 0.25},
+		{Detector: &UserAgentChurnDetector{}, Weight: 0.15},
+		{Detector: &EndpointCardinalityDetector{}, Weight: 0.15},
+		{Detector: &RequestSpikeDetector{}, Weight: 0.10},
+	}
+	if locator == nil {
+		detectors = append(detectors[:1], detectors[2:]...)
+	}
+	return detectors
+}
+
+// eventTime is when the event happened, events without a timestamp happen now
+func eventTime(event RateLimitEvent) time.Time {
+	if event.Timestamp == 0 {
+		return time.Now()
+	}
+	return time.Unix(0, event.Timestamp)
+}
+
+// ramp maps value to 0 at low, 1 at high and linearly in between
+func ramp(value, low, high float64) float64 {
+	if high <= low {
+		if value >= high {
+			return 1
+		}
+		return 0
+	}
+	return min(max((value-low)/(high-low), 0), 1)
+}
+
+// actorStates keeps a detector's state per actor. Actors idle for longer than ttl are
+// dropped, checked at most once per ttl, so memory follows the recently active actors
+type actorStates[T any] struct {
+	mu        sync.Mutex
+	states    map[string]*actorState[T]
+	lastPrune time.Time
+}
+
+type actorState[T any] struct {
+	value    T
+	lastSeen time.Time
+}
+
+// update runs fn on the state of actor at now and returns its result.
+// fn runs under the lock and must not keep the state
+func (a *actorStates[T]) update(actor string, now time.Time, ttl time.Duration, fn func(state *T) float64) float64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.states == nil {
+		a.states = make(map[string]*actorState[T])
+	}
+	if now.Sub(a.lastPrune) > ttl {
+		for key, state := range a.states {
+			if now.Sub(state.lastSeen) > ttl {
+				delete(a.states, key)
+			}
+		}
+		a.lastPrune = now
+	}
+
+	state, ok := a.states[actor]
+	if !ok {
+		state = &actorState[T]{}
+		a.states[actor] = state
+	}
+	if now.After(state.lastSeen) {
+		state.lastSeen = now
+	}
+	return fn(&state.value)
+}
+
+// view runs fn on the state of actor, if it has any, without marking the actor as seen
+func (a *actorStates[T]) view(actor string, fn func(state *T)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if state, ok := a.states[actor]; ok {
+		fn(&state.value)
+	}
+}
+
+// len returns the number of actors with state
+func (a *actorStates[T]) len() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.states)
+}
+
+// recentSet holds the distinct values seen within a window, at most limit of them:
+// when full the value seen longest ago makes room for a new one
+type recentSet map[string]time.Time
+
+// count forgets values last seen before now-window and returns how many are left
+func (s recentSet) count(now time.Time, window time.Duration) int {
+	for v, seen := range s {
+		if !seen.After(now.Add(-window)) {
+			delete(s, v)
+		}
+	}
+	return len(s)
+}
+
+// add records value at now, forgets values last seen before now-window and returns the count
+func (s recentSet) add(value string, now time.Time, window time.Duration, limit int) int {
+	if _, ok := s[value]; !ok && s.count(now, window) >= limit {
+		oldest := ""
+		for v, seen := range s {
+			if oldest == "" || seen.Before(s[oldest]) {
+				oldest = v
+			}
+		}
+		delete(s, oldest)
+	}
+	if now.After(s[value]) {
+		s[value] = now
+	}
+	return len(s)
+}
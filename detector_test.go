@@ -0,0 +1,465 @@
+package ankylogo
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// start is the time synthetic event sequences begin at
+var start = time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+// helper building an event at offset after start
+func eventAt(offset time.Duration, event RateLimitEvent) RateLimitEvent {
+	if event.Action == "" {
+		event.Action = "ALLOWED"
+	}
+	if event.StatusCode == 0 {
+		event.StatusCode = 200
+	}
+	event.Timestamp = start.Add(offset).UnixNano()
+	return event
+}
+
+/*
+Testing the failed auth detector
+3 failures out of a threshold of 6 give half a signal, successful responses and
+rate limiter denials add nothing, and failures older than the window stop counting
+*/
+func TestFailedAuthDetector(t *testing.T) {
+	d := &FailedAuthDetector{Window: time.Minute, Threshold: 6}
+
+	var signal float64
+	for i := 0; i < 3; i++ {
+		signal = d.Observe("a", eventAt(time.Duration(i)*time.Second, RateLimitEvent{StatusCode: 401}))
+	}
+	if signal != 0.5 {
+		t.Errorf("3 failures of 6 should give a signal of 0.5, got %f", signal)
+	}
+	signal = d.Observe("a", eventAt(5*time.Second, RateLimitEvent{StatusCode: 200}))
+	signal = d.Observe("a", eventAt(6*time.Second, RateLimitEvent{Action: "DENIED_RISK", StatusCode: 403}))
+	if signal != 0.5 {
+		t.Errorf("Successes and denials should not count as failures, got %f", signal)
+	}
+	if signal := d.Observe("a", eventAt(2*time.Minute, RateLimitEvent{StatusCode: 403})); signal != 1.0/6 {
+		t.Errorf("Only the failure within the window should count, got %f", signal)
+	}
+}
+
+// helper building a failed sign-in of username from ip at offset after start
+func failedLogin(offset time.Duration, ip, username string) RateLimitEvent {
+	return eventAt(offset, RateLimitEvent{IP: ip, Username: username, StatusCode: 401})
+}
+
+/*
+Testing credential stuffing
+One IP failing once on each of 5 usernames gives a full signal, half of the failures
+the plain count needs. Other IPs failing on those usernames once are not flagged
+*/
+func TestFailedAuthCredentialStuffing(t *testing.T) {
+	d := &FailedAuthDetector{}
+
+	var signal float64
+	for i := 0; i < 5; i++ {
+		signal = d.Observe("10.0.0.1", failedLogin(time.Duration(i)*time.Second, "10.0.0.1", fmt.Sprintf("user%d", i)))
+	}
+	if signal != 1 {
+		t.Errorf("5 usernames from one IP should give a full signal, got %f", signal)
+	}
+	if pattern := d.Pattern("10.0.0.1"); pattern != CredentialStuffing {
+		t.Errorf("Expected credential stuffing, got %v", pattern)
+	}
+	if signal := d.Observe("10.0.0.2", failedLogin(10*time.Second, "10.0.0.2", "user0")); signal != 0.1 {
+		t.Errorf("A single failure of another IP should only count once, got %f", signal)
+	}
+}
+
+/*
+Testing brute force
+5 IPs failing once each on one username give the 5th a full signal.
+One IP failing on one username is brute force as well, scored by the plain count
+*/
+func TestFailedAuthBruteForce(t *testing.T) {
+	d := &FailedAuthDetector{}
+
+	var signal float64
+	for i := 1; i <= 5; i++ {
+		ip := fmt.Sprintf("10.0.0.%d", i)
+		signal = d.Observe(ip, failedLogin(time.Duration(i)*time.Second, ip, "alice"))
+	}
+	if signal != 1 {
+		t.Errorf("5 IPs failing on one username should give a full signal, got %f", signal)
+	}
+	if pattern := d.Pattern("10.0.0.5"); pattern != BruteForce {
+		t.Errorf("Expected brute force, got %v", pattern)
+	}
+
+	for i := 0; i < 4; i++ {
+		signal = d.Observe("10.0.1.1", failedLogin(time.Duration(i)*time.Second, "10.0.1.1", "bob"))
+	}
+	if signal != 0.4 || d.Pattern("10.0.1.1") != BruteForce {
+		t.Errorf("4 failures on one username should be brute force with a signal of 0.4, got %f %v", signal, d.Pattern("10.0.1.1"))
+	}
+	if pattern := d.Pattern("10.0.2.1"); pattern != NoAuthPattern {
+		t.Errorf("An unknown actor should have no pattern, got %v", pattern)
+	}
+}
+
+/*
+Testing the user agent churn detector
+One user agent gives no signal, 5 distinct ones in the window give a full signal,
+and a new window starts from scratch
+*/
+func TestUserAgentChurnDetector(t *testing.T) {
+	d := &UserAgentChurnDetector{Window: time.Minute, Threshold: 5}
+
+	for i := 0; i < 10; i++ {
+		if signal := d.Observe("a", eventAt(time.Duration(i)*time.Second, RateLimitEvent{UserAgent: "Mozilla/5.0"})); signal != 0 {
+			t.Fatalf("A single user agent should give no signal, got %f", signal)
+		}
+	}
+	var signal float64
+	for i := 0; i < 5; i++ {
+		signal = d.Observe("b", eventAt(time.Duration(i)*time.Second, RateLimitEvent{UserAgent: fmt.Sprintf("bot/%d", i)}))
+	}
+	if signal != 1 {
+		t.Errorf("5 distinct user agents should give a full signal, got %f", signal)
+	}
+	if signal := d.Observe("b", eventAt(5*time.Minute, RateLimitEvent{UserAgent: "bot/0"})); signal != 0 {
+		t.Errorf("User agents outside the window should be forgotten, got %f", signal)
+	}
+}
+
+/*
+Testing empty and known-bad user agents
+A request without a User-Agent gives half a signal, a scanner's a full one.
+Browsers and custom lists are matched ignoring case
+*/
+func TestUserAgentChurnBadAgents(t *testing.T) {
+	d := &UserAgentChurnDetector{}
+	if signal := d.Observe("a", eventAt(0, RateLimitEvent{})); signal != 0.5 {
+		t.Errorf("An empty user agent should give half a signal, got %f", signal)
+	}
+	if signal := d.Observe("b", eventAt(0, RateLimitEvent{UserAgent: "sqlmap/1.7.2#stable (https://sqlmap.org)"})); signal != 1 {
+		t.Errorf("sqlmap should give a full signal, got %f", signal)
+	}
+	if signal := d.Observe("c", eventAt(0, RateLimitEvent{UserAgent: "Mozilla/5.0 (X11; Linux x86_64) Firefox/130.0"})); signal != 0 {
+		t.Errorf("A browser should give no signal, got %f", signal)
+	}
+
+	custom := &UserAgentChurnDetector{BadAgents: []string{"Python-Requests"}}
+	if signal := custom.Observe("d", eventAt(0, RateLimitEvent{UserAgent: "python-requests/2.31"})); signal != 1 {
+		t.Errorf("A custom bad agent should give a full signal, got %f", signal)
+	}
+}
+
+/*
+Testing the HyperLogLog sketch
+Estimates stay within 25% from 10 to 100000 distinct values, repeats don't count
+and two merged sketches count their union
+*/
+func TestHyperLogLog(t *testing.T) {
+	var h hyperLogLog
+	added := 0
+	for _, n := range []int{10, 100, 1000, 10000, 100000} {
+		for ; added < n; added++ {
+			h.add(fmt.Sprintf("agent-%d", added))
+			h.add(fmt.Sprintf("agent-%d", added/2))
+		}
+		if estimate := h.estimate(); estimate < float64(n)*0.75 || estimate > float64(n)*1.25 {
+			t.Errorf("Expected about %d distinct values, got %.0f", n, estimate)
+		}
+	}
+
+	var a, b hyperLogLog
+	for i := 0; i < 1000; i++ {
+		a.add(fmt.Sprintf("a-%d", i))
+		b.add(fmt.Sprintf("b-%d", i))
+	}
+	a.merge(&b)
+	if estimate := a.estimate(); estimate < 1500 || estimate > 2500 {
+		t.Errorf("Expected about 2000 distinct values in the union, got %.0f", estimate)
+	}
+}
+
+/*
+Testing the endpoint cardinality detector
+Up to 10 of a threshold of 50 endpoints is ordinary, 50 give a full signal
+*/
+func TestEndpointCardinalityDetector(t *testing.T) {
+	d := &EndpointCardinalityDetector{Window: time.Minute, Threshold: 50}
+
+	var signal float64
+	for i := 0; i < 10; i++ {
+		signal = d.Observe("a", eventAt(time.Duration(i)*time.Second, RateLimitEvent{Endpoint: fmt.Sprintf("GET /page%d", i)}))
+	}
+	if signal != 0 {
+		t.Errorf("10 endpoints should be ordinary, got %f", signal)
+	}
+	for i := 10; i < 50; i++ {
+		signal = d.Observe("a", eventAt(time.Duration(i)*100*time.Millisecond, RateLimitEvent{Endpoint: fmt.Sprintf("GET /page%d", i)}))
+	}
+	if signal != 1 {
+		t.Errorf("50 endpoints should give a full signal, got %f", signal)
+	}
+}
+
+/*
+Testing enumeration of one route
+40 ids on GET /users/:id are within the path baseline of 50, 1000 ids give a full signal.
+A lower Baseline flags fewer routes
+*/
+func TestEndpointCardinalityPaths(t *testing.T) {
+	d := &EndpointCardinalityDetector{Window: time.Hour}
+
+	var signal float64
+	for i := 0; i < 1000; i++ {
+		signal = d.Observe("a", eventAt(time.Duration(i)*time.Second, RateLimitEvent{Endpoint: "GET /users/:id", Path: fmt.Sprintf("/users/%d", i)}))
+		if i == 39 && signal != 0 {
+			t.Errorf("40 ids should be within the baseline, got %f", signal)
+		}
+	}
+	if signal != 1 {
+		t.Errorf("1000 ids should give a full signal, got %f", signal)
+	}
+
+	custom := &EndpointCardinalityDetector{Baseline: 2, Threshold: 4}
+	for i := 0; i < 3; i++ {
+		signal = custom.Observe("a", eventAt(0, RateLimitEvent{Endpoint: fmt.Sprintf("GET /page%d", i)}))
+	}
+	if signal != 0.5 {
+		t.Errorf("3 endpoints between a baseline of 2 and a threshold of 4 should give half a signal, got %f", signal)
+	}
+}
+
+/*
+Testing the request spike detector
+30 requests a minute for half an hour is the baseline, 30 more in the next minute are
+no spike, 330 in a minute are 11 times the baseline: a full signal
+*/
+func TestRequestSpikeDetector(t *testing.T) {
+	d := &RequestSpikeDetector{}
+
+	var signal float64
+	for minute := 0; minute < 31; minute++ {
+		for i := 0; i < 30; i++ {
+			offset := time.Duration(minute)*time.Minute + time.Duration(i)*time.Second
+			signal = d.Observe("a", eventAt(offset, RateLimitEvent{}))
+		}
+	}
+	if signal != 0 {
+		t.Errorf("A steady rate should give no signal, got %f", signal)
+	}
+	for i := 0; i < 330; i++ {
+		offset := 31*time.Minute + time.Duration(i)*100*time.Millisecond
+		signal = d.Observe("a", eventAt(offset, RateLimitEvent{}))
+	}
+	if signal != 1 {
+		t.Errorf("11 times the baseline should give a full signal, got %f", signal)
+	}
+}
+
+/*
+Testing the warm-up of the request spike detector
+A new actor's first burst of 300 requests is no spike. The same burst 5 minutes
+later, after 4 quiet minutes, is about 6 times the baseline
+*/
+func TestRequestSpikeWarmUp(t *testing.T) {
+	d := &RequestSpikeDetector{}
+
+	for i := 0; i < 300; i++ {
+		if signal := d.Observe("a", eventAt(time.Duration(i)*100*time.Millisecond, RateLimitEvent{})); signal != 0 {
+			t.Fatalf("A new actor should not be flagged, got %f at request %d", signal, i+1)
+		}
+	}
+	var signal float64
+	for i := 0; i < 300; i++ {
+		signal = d.Observe("a", eventAt(5*time.Minute+time.Duration(i)*100*time.Millisecond, RateLimitEvent{}))
+	}
+	if signal <= 0 || signal == 1 {
+		t.Errorf("Expected a partial signal once warmed up, got %f", signal)
+	}
+}
+
+/*
+Testing that the request spike baseline follows the actor
+After 20 minutes at 100 requests a minute, 250 requests are 2.5 times the baseline,
+barely a signal, while the same 250 from an actor at 10 a minute give a full one
+*/
+func TestRequestSpikeBaseline(t *testing.T) {
+	d := &RequestSpikeDetector{}
+
+	burst := func(actor string, perMinute int) float64 {
+		for minute := 0; minute < 20; minute++ {
+			for i := 0; i < perMinute; i++ {
+				offset := time.Duration(minute)*time.Minute + time.Duration(i)*time.Minute/time.Duration(perMinute)
+				d.Observe(actor, eventAt(offset, RateLimitEvent{}))
+			}
+		}
+		var signal float64
+		for i := 0; i < 250; i++ {
+			signal = d.Observe(actor, eventAt(20*time.Minute+time.Duration(i)*100*time.Millisecond, RateLimitEvent{}))
+		}
+		return signal
+	}
+	if signal := burst("busy", 100); signal > 0.1 {
+		t.Errorf("2.5 times the baseline should barely be a signal, got %f", signal)
+	}
+	if signal := burst("quiet", 10); signal != 1 {
+		t.Errorf("25 times the baseline should give a full signal, got %f", signal)
+	}
+}
+
+// mapLocator resolves IPs from a fixed table
+type mapLocator map[string][2]float64
+
+func (m mapLocator) Locate(ip string) (float64, float64, bool) {
+	location, ok := m[ip]
+	return location[0], location[1], ok
+}
+
+/*
+Testing the geo velocity detector
+New York then London an hour later is impossible travel, London then Paris
+(about 340 km) two hours later is not, and unknown IPs are ignored
+*/
+func TestGeoVelocityDetector(t *testing.T) {
+	d := &GeoVelocityDetector{Locator: mapLocator{
+		"198.51.100.1": {40.71, -74.01}, // New York
+		"198.51.100.2": {51.51, -0.13},  // London
+		"198.51.100.3": {48.86, 2.35},   // Paris
+	}}
+
+	if signal := d.Observe("a", eventAt(0, RateLimitEvent{IP: "198.51.100.1"})); signal != 0 {
+		t.Errorf("The first location should give no signal, got %f", signal)
+	}
+	if signal := d.Observe("a", eventAt(time.Hour, RateLimitEvent{IP: "198.51.100.2"})); signal != 1 {
+		t.Errorf("New York to London in an hour should be impossible travel, got %f", signal)
+	}
+	if signal := d.Observe("a", eventAt(3*time.Hour, RateLimitEvent{IP: "198.51.100.3"})); signal != 0 {
+		t.Errorf("London to Paris in two hours should be possible, got %f", signal)
+	}
+	if signal := d.Observe("a", eventAt(3*time.Hour, RateLimitEvent{IP: "203.0.113.9"})); signal != 0 {
+		t.Errorf("An IP without a location should give no signal, got %f", signal)
+	}
+	if signal := (&GeoVelocityDetector{}).Observe("a", eventAt(0, RateLimitEvent{IP: "198.51.100.1"})); signal != 0 {
+		t.Errorf("Without a locator the detector should stay silent, got %f", signal)
+	}
+}
+
+/*
+Testing the MaxMind locator on the fixture database in testdata
+(regenerate it with go run testdata/make_geo_fixture.go)
+*/
+func TestMaxMindLocator(t *testing.T) {
+	locator, err := NewMaxMindLocator("testdata/geo-fixture.mmdb")
+	if err != nil {
+		t.Fatalf("Failed to open the fixture database: %v", err)
+	}
+	defer locator.Close()
+
+	if latitude, longitude, ok := locator.Locate("198.51.100.7"); !ok || latitude != 51.5074 || longitude != -0.1278 {
+		t.Errorf("198.51.100.7 should be in London, got %f %f %v", latitude, longitude, ok)
+	}
+	for _, ip := range []string{"198.19.0.1", "10.0.0.1", "2001:db8::1", "not an ip"} {
+		if _, _, ok := locator.Locate(ip); ok {
+			t.Errorf("%s should have no location", ip)
+		}
+	}
+	if _, err := NewMaxMindLocator("testdata/missing.mmdb"); err == nil {
+		t.Error("Opening a missing database should fail")
+	}
+}
+
+/*
+Testing impossible travel with the fixture database
+An API key used from New York and 3 hours later from Sydney has travelled impossibly fast,
+from London and 2 hours later from Paris it has not.
+Actors identified by their IP are never flagged
+*/
+func TestGeoVelocityMaxMind(t *testing.T) {
+	locator, err := NewMaxMindLocator("testdata/geo-fixture.mmdb")
+	if err != nil {
+		t.Fatalf("Failed to open the fixture database: %v", err)
+	}
+	defer locator.Close()
+	d := &GeoVelocityDetector{Locator: locator}
+
+	key := "header:" + hashIdentity("key-1")
+	steps := []struct {
+		offset time.Duration
+		ip     string
+		signal float64
+	}{
+		{0, "192.0.2.10", 0},               // New York
+		{3 * time.Hour, "203.0.113.5", 1},  // Sydney, about 16000 km
+		{4 * time.Hour, "198.51.100.1", 1}, // London, about 17000 km
+		{6 * time.Hour, "198.18.0.9", 0},   // Paris, about 340 km
+		{6 * time.Hour, "198.19.0.1", 0},   // no location
+	}
+	for _, step := range steps {
+		if signal := d.Observe(key, eventAt(step.offset, RateLimitEvent{IP: step.ip})); signal != step.signal {
+			t.Errorf("%s after %v: expected a signal of %.0f, got %f", step.ip, step.offset, step.signal, signal)
+		}
+	}
+
+	for i, ip := range []string{"192.0.2.10", "203.0.113.5"} {
+		if signal := d.Observe(ip, eventAt(time.Duration(i)*time.Minute, RateLimitEvent{IP: ip})); signal != 0 {
+			t.Errorf("An actor identified by its IP should never be flagged, got %f", signal)
+		}
+	}
+}
+
+/*
+Testing the default detectors
+Without a locator the geo detector is left out and the other four weigh 0.75,
+with one it is in and resolves IPs through it, the weights then add up to 1
+*/
+func TestDefaultDetectors(t *testing.T) {
+	cases := []struct {
+		locator Locator
+		count   int
+		total   float64
+	}{
+		{nil, 4, 0.75},
+		{mapLocator{}, 5, 1},
+	}
+	for _, c := range cases {
+		detectors := DefaultDetectors(c.locator)
+		if len(detectors) != c.count {
+			t.Errorf("Expected %d detectors with locator %v, got %d", c.count, c.locator, len(detectors))
+		}
+		var total float64
+		var geo *GeoVelocityDetector
+		for _, d := range detectors {
+			total += d.Weight
+			if g, ok := d.Detector.(*GeoVelocityDetector); ok {
+				geo = g
+			}
+		}
+		if total < c.total-0.001 || total > c.total+0.001 {
+			t.Errorf("Weights with locator %v should add up to %.2f, got %f", c.locator, c.total, total)
+		}
+		if (geo != nil) != (c.locator != nil) {
+			t.Errorf("The geo detector should be included only with a locator, got %v with locator %v", geo, c.locator)
+		}
+		if geo != nil && geo.Locator == nil {
+			t.Errorf("The geo detector should resolve IPs with the locator")
+		}
+	}
+}
+
+/*
+Testing that detectors forget idle actors
+After a window without events from 100 actors only the newest actor is left
+*/
+func TestDetectorForgetsIdleActors(t *testing.T) {
+	d := &UserAgentChurnDetector{Window: time.Minute}
+	for i := 0; i < 100; i++ {
+		d.Observe(fmt.Sprintf("actor%d", i), eventAt(0, RateLimitEvent{UserAgent: "curl/8.0"}))
+	}
+	d.Observe("late", eventAt(2*time.Minute, RateLimitEvent{UserAgent: "curl/8.0"}))
+	if n := d.actors.len(); n != 1 {
+		t.Errorf("Only the newest actor should be kept, got %d", n)
+	}
+}
@@ -0,0 +1,66 @@
+package ankylogo
+
+import (
+	"time"
+)
+
+// Dimension is one independently tracked limit, e.g. "ip" or "apikey".
+// Every configured dimension is checked on each request and the request is
+// denied as soon as any of them is exhausted.
+type Dimension struct {
+	// Name namespaces the dimension's counters in the store and is reported
+	// in RateLimitEvent.Dimension when this dimension denies a request
+	Name string
+	// KeyExtractor picks the identity for this dimension. If it finds nothing
+	// (e.g. no API key on an anonymous request) the dimension is skipped
+	KeyExtractor KeyExtractor
+	// sliding window
+	Window time.Duration
+	Limit  int
+	// token bucket
+	Capacity          int
+	TokensPerInterval int
+	RefillRate        time.Duration
+	BucketAlgorithm   BucketAlgorithm
+}
+
+// dimensions returns the limits a config enforces. Without explicit
+// Dimensions the top level fields act as a single unnamed dimension.
+func (c Config) dimensions() []Dimension {
+	if len(c.Dimensions) > 0 {
+		return c.Dimensions
+	}
+	return []Dimension{{
+		KeyExtractor:      c.KeyExtractor,
+		Window:            c.Window,
+		Limit:             c.Limit,
+		Capacity:          c.Capacity,
+		TokensPerInterval: c.TokensPerInterval,
+		RefillRate:        c.RefillRate,
+		BucketAlgorithm:   c.BucketAlgorithm,
+	}}
+}
+
+// enabled reports whether the dimension has any algorithm configured
+func (d Dimension) enabled() bool {
+	return (d.Window > 0 && d.Limit > 0) || d.Capacity > 0
+}
+
+// scaled returns a copy of the dimension with its limits reduced by factor.
+// Only limits that were originally configured (> 0) are reduced
+// to avoid re-enabling algorithms the user intentionally disabled
+func (d Dimension) scaled(factor float64) Dimension {
+	if d.Limit > 0 {
+		d.Limit = int(float64(d.Limit) * factor)
+		if d.Limit < 1 {
+			d.Limit = 1
+		}
+	}
+	if d.Capacity > 0 {
+		d.Capacity = int(float64(d.Capacity) * factor)
+		if d.Capacity < 1 {
+			d.Capacity = 1
+		}
+	}
+	return d
+}
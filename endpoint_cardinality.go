@@ -0,0 +1,70 @@
+package ankylogo
+
+import "time"
+
+// EndpointCardinalityDetector flags actors that reach an unusual number of different
+// endpoints in a short time, as when an API is scraped or enumerated.
+// It counts routes ("GET /users/:id") and, on events that carry one, raw paths ("/users/42"),
+// so walking through ids on a single route is caught as well. The raw paths of an actor are
+// checked against their own baseline, PathBaseline, well above Baseline as one route serves many paths
+type EndpointCardinalityDetector struct {
+	// Window is how far back endpoints count (0 = 10 minutes)
+	Window time.Duration
+	// Baseline is the number of distinct endpoints within Window an ordinary actor reaches,
+	// up to it gives no signal (0 = 10)
+	Baseline int
+	// Threshold is the number of distinct endpoints within Window that gives a full signal (0 = 5 * Baseline)
+	Threshold int
+	// PathBaseline is the number of distinct raw paths within Window an ordinary actor reaches (0 = 50)
+	PathBaseline int
+	// PathThreshold is the number of distinct raw paths within Window that gives a full signal (0 = 10 * PathBaseline)
+	PathThreshold int
+
+	actors actorStates[endpointState]
+}
+
+type endpointState struct {
+	endpoints recentSet
+	paths     rollingSketch
+}
+
+func (d *EndpointCardinalityDetector) Name() string {
+	return "endpoint_cardinality"
+}
+
+func (d *EndpointCardinalityDetector) Observe(actor string, event RateLimitEvent) float64 {
+	window := d.Window
+	if window <= 0 {
+		window = 10 * time.Minute
+	}
+	baseline := d.Baseline
+	if baseline <= 0 {
+		baseline = 10
+	}
+	threshold := d.Threshold
+	if threshold <= 0 {
+		threshold = 5 * baseline
+	}
+	pathBaseline := d.PathBaseline
+	if pathBaseline <= 0 {
+		pathBaseline = 50
+	}
+	pathThreshold := d.PathThreshold
+	if pathThreshold <= 0 {
+		pathThreshold = 10 * pathBaseline
+	}
+
+	now := eventTime(event)
+	return d.actors.update(actor, now, window, func(state *endpointState) float64 {
+		if state.endpoints == nil {
+			state.endpoints = make(recentSet)
+		}
+		endpoints := state.endpoints.add(event.Endpoint, now, window, threshold)
+		signal := ramp(float64(endpoints), float64(baseline), float64(threshold))
+		if event.Path != "" {
+			paths := state.paths.add(event.Path, now, window)
+			signal = max(signal, ramp(paths, float64(pathBaseline), float64(pathThreshold)))
+		}
+		return signal
+	})
+}
@@ -37,7 +37,7 @@ func main() {
 	// - Sliding window: 100 requests per 60 seconds
 	// - Token bucket: 10 token capacity, refills 1 token per second
 	config := ankylogo.Config{
-		Window:            60,          // 60 second sliding window
+		Window:            time.Minute, // 60 second sliding window
 		Limit:             100,         // 100 requests max in the window
 		Capacity:          10,          // 10 token bucket capacity
 		TokensPerInterval: 1,           // refill 1 token per interval
@@ -0,0 +1,149 @@
+package ankylogo
+
+import (
+	"net/http"
+	"time"
+)
+
+// AuthPattern is the kind of attack an actor's failed sign-ins look like
+type AuthPattern int
+
+const (
+	// NoAuthPattern means no failed sign-ins within the window
+	NoAuthPattern AuthPattern = iota
+	// BruteForce is guessing the password of one username, from one or many IPs
+	BruteForce
+	// CredentialStuffing is trying many usernames from one IP, e.g. with a leaked list
+	CredentialStuffing
+)
+
+func (p AuthPattern) String() string {
+	switch p {
+	case BruteForce:
+		return "brute_force"
+	case CredentialStuffing:
+		return "credential_stuffing"
+	default:
+		return "none"
+	}
+}
+
+// FailedAuthDetector flags actors whose requests keep failing authentication:
+// many 401 and 403 responses in a short time. Only responses of the handler count,
+// not denials of the rate limiter itself.
+// With usernames on the events (Config.Username) it also flags an IP trying many
+// usernames (credential stuffing) and every IP guessing at a username that fails
+// from many IPs (brute force), each well before the plain failure count would
+type FailedAuthDetector struct {
+	// Window is how far back failures count (0 = 5 minutes)
+	Window time.Duration
+	// Threshold is the number of failures within Window that gives a full signal (0 = 10)
+	Threshold int
+	// Usernames is the number of distinct usernames one IP fails on within Window
+	// that gives a full signal (0 = 5)
+	Usernames int
+	// Sources is the number of distinct IPs failing on one username within Window
+	// that gives a full signal (0 = 5)
+	Sources int
+
+	actors    actorStates[failedAuthState]
+	usernames actorStates[recentSet] // IPs failing on each username
+}
+
+type failedAuthState struct {
+	failures  []time.Time // within the window, oldest first
+	usernames recentSet   // usernames failed on within the window
+	pattern   AuthPattern
+}
+
+func (d *FailedAuthDetector) Name() string {
+	return "failed_auth"
+}
+
+func (d *FailedAuthDetector) Observe(actor string, event RateLimitEvent) float64 {
+	window := d.Window
+	if window <= 0 {
+		window = 5 * time.Minute
+	}
+	threshold := d.Threshold
+	if threshold <= 0 {
+		threshold = 10
+	}
+	usernameLimit := d.Usernames
+	if usernameLimit <= 0 {
+		usernameLimit = 5
+	}
+	sourceLimit := d.Sources
+	if sourceLimit <= 0 {
+		sourceLimit = 5
+	}
+
+	now := eventTime(event)
+	failed := event.Action == "ALLOWED" &&
+		(event.StatusCode == http.StatusUnauthorized || event.StatusCode == http.StatusForbidden)
+
+	// brute force: how many IPs fail on the username this request targeted
+	sources := 0
+	if failed && event.Username != "" {
+		source := event.IP
+		if source == "" {
+			source = actor
+		}
+		d.usernames.update(event.Username, now, window, func(ips *recentSet) float64 {
+			if *ips == nil {
+				*ips = recentSet{}
+			}
+			sources = ips.add(source, now, window, sourceLimit)
+			return 0
+		})
+	}
+
+	return d.actors.update(actor, now, window, func(state *failedAuthState) float64 {
+		kept := state.failures[:0]
+		for _, at := range state.failures {
+			if at.After(now.Add(-window)) {
+				kept = append(kept, at)
+			}
+		}
+		if failed {
+			kept = append(kept, now)
+		}
+		// failures past the threshold change nothing, keep only as many as it takes
+		if len(kept) > threshold {
+			kept = kept[len(kept)-threshold:]
+		}
+		state.failures = kept
+
+		// credential stuffing: how many usernames this actor failed on
+		if state.usernames == nil {
+			state.usernames = recentSet{}
+		}
+		usernames := state.usernames.count(now, window)
+		if failed && event.Username != "" {
+			usernames = state.usernames.add(event.Username, now, window, usernameLimit)
+		}
+
+		switch {
+		case len(kept) == 0:
+			state.pattern = NoAuthPattern
+		case usernames > 1:
+			state.pattern = CredentialStuffing
+		default:
+			state.pattern = BruteForce
+		}
+		return max(
+			float64(len(kept))/float64(threshold),
+			ramp(float64(usernames), 2, float64(usernameLimit)),
+			ramp(float64(sources), 2, float64(sourceLimit)),
+		)
+	})
+}
+
+// Pattern returns what the actor's latest failed sign-ins look like
+func (d *FailedAuthDetector) Pattern(actor string) AuthPattern {
+	pattern := NoAuthPattern
+	d.actors.view(actor, func(state *failedAuthState) {
+		pattern = state.pattern
+	})
+	return pattern
+}
@@ -0,0 +1,195 @@
+package ankylogo
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The following block implements the generic cell rate algorithm (GCRA).
+// It behaves like a token bucket that refills continuously, but stores a single value:
+// the theoretical arrival time (TAT) at which the bucket would be full again.
+// Each token pushes the TAT one emission interval further, and a request is allowed
+// while the TAT stays within capacity emission intervals of now.
+// The TAT is swapped with compare-and-swap, requests never wait on each other.
+
+var _ RateLimiter = (*GCRA)(nil)
+
+type GCRA struct {
+	capacity atomic.Int64
+	// state is the TAT in unix nanoseconds, or the tokens taken when the bucket never refills
+	state    atomic.Int64
+	emission time.Duration // time to earn back one token, 0 = never
+	mu       sync.RWMutex  // held for writing only to change emission, which changes what state means
+}
+
+// NewGCRA takes the same parameters as NewTokenBucket: a burst of capacity and
+// tokensPerInterval earned back every refillRate, spread evenly over the interval
+func NewGCRA(capacity, tokensPerInterval int, refillRate time.Duration) *GCRA {
+	g := &GCRA{emission: gcraEmission(tokensPerInterval, refillRate)}
+	g.capacity.Store(int64(capacity))
+	return g
+}
+
+// gcraEmission is the time it takes to earn back one token. Like the token bucket,
+// a tokensPerInterval or refillRate of 0 means tokens are never earned back: 0 is returned
+func gcraEmission(tokensPerInterval int, refillRate time.Duration) time.Duration {
+	if tokensPerInterval <= 0 || refillRate <= 0 {
+		return 0
+	}
+	return max(refillRate/time.Duration(tokensPerInterval), 1)
+}
+
+func (g *GCRA) Allow() bool {
+	allowed, _ := g.AllowN(1)
+	return allowed
+}
+
+// AllowN takes cost tokens if they are all available and returns the state afterwards
+func (g *GCRA) AllowN(cost int) (bool, Quota) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	for {
+		now := time.Now().UnixNano()
+		state := g.state.Load()
+		capacity := g.capacity.Load()
+		next, ok := g.next(now, state, capacity, cost)
+		if !ok {
+			return false, g.quota(now, state, capacity, cost)
+		}
+		if g.state.CompareAndSwap(state, next) {
+			return true, g.quota(now, next, capacity, 0)
+		}
+	}
+}
+
+// next returns the state after taking cost tokens at now and whether they are available,
+// caller must hold g.mu
+func (g *GCRA) next(now, state, capacity int64, cost int) (int64, bool) {
+	if g.emission == 0 {
+		// without refills the TAT never moves, the burst is all there is
+		return state + int64(cost), state+int64(cost) <= capacity
+	}
+	newTat := max(state, now) + int64(cost)*int64(g.emission)
+	return newTat, now >= newTat-g.burst(capacity)
+}
+
+// configure applies the parameters of the current request. The tokens taken so far
+// still count, a lower capacity shrinks the burst left immediately
+func (g *GCRA) configure(capacity, tokensPerInterval int, refillRate time.Duration) {
+	// the capacity only bounds how far the TAT may run ahead, the TAT means the same under any capacity
+	g.capacity.Store(int64(capacity))
+
+	emission := gcraEmission(tokensPerInterval, refillRate)
+	g.mu.RLock()
+	unchanged := emission == g.emission
+	g.mu.RUnlock()
+	if unchanged {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now().UnixNano()
+	state := g.state.Load()
+	// carry the tokens owed over to the new emission interval
+	switch {
+	case g.emission == 0:
+		g.state.Store(now + state*int64(emission))
+	case emission == 0:
+		owed := max(state-now, 0)
+		g.state.Store((owed + int64(g.emission) - 1) / int64(g.emission))
+	default:
+		owed := max(state-now, 0)
+		g.state.Store(now + int64(float64(owed)*float64(emission)/float64(g.emission)))
+	}
+	g.emission = emission
+}
+
+// peek reports whether cost tokens are available and the state of the bucket, without taking them
+func (g *GCRA) peek(cost int) (bool, Quota) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	now := time.Now().UnixNano()
+	state := g.state.Load()
+	capacity := g.capacity.Load()
+	if _, ok := g.next(now, state, capacity, cost); ok {
+		return true, g.quota(now, state, capacity, 0)
+	}
+	return false, g.quota(now, state, capacity, cost)
+}
+
+func (g *GCRA) take(cost int) (bool, Quota) {
+	return g.AllowN(cost)
+}
+
+// refund gives back cost tokens taken by a request that was denied elsewhere
+func (g *GCRA) refund(cost int) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	for {
+		state := g.state.Load()
+		refunded := state - int64(cost)*int64(g.emission)
+		if g.emission == 0 {
+			refunded = max(state-int64(cost), 0)
+		}
+		if g.state.CompareAndSwap(state, refunded) {
+			return
+		}
+	}
+}
+
+// Debit takes cost tokens unconditionally, pushing the TAT past the burst
+// tolerance means the actor has to wait for the debt before the next request
+func (g *GCRA) Debit(cost int) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	for {
+		state := g.state.Load()
+		next, _ := g.next(time.Now().UnixNano(), state, g.capacity.Load(), cost)
+		if g.state.CompareAndSwap(state, next) {
+			return
+		}
+	}
+}
+
+// burst is how far the TAT may run ahead of now, caller must hold g.mu
+func (g *GCRA) burst(capacity int64) int64 {
+	return capacity * int64(g.emission)
+}
+
+// recoveredAt is the TAT, the time at which the bucket is full again,
+// never if it does not refill and tokens were taken
+func (g *GCRA) recoveredAt() (time.Time, bool) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	state := g.state.Load()
+	if g.emission == 0 {
+		return time.Time{}, state == 0
+	}
+	return time.Unix(0, state), true
+}
+
+// quota describes the bucket for a response, caller must hold g.mu.
+// needed is the cost of a denied request, used to work out when it would fit
+func (g *GCRA) quota(now, state, capacity int64, needed int) Quota {
+	if g.emission == 0 {
+		// no ResetAt or RetryAfter, the bucket is never full again
+		return Quota{Limit: int(capacity), Remaining: int(max(capacity-state, 0))}
+	}
+	// a TAT in the past means the bucket is full
+	tat := max(state, now)
+	available := (g.burst(capacity) - (tat - now)) / int64(g.emission)
+	q := Quota{Limit: int(capacity), Remaining: int(max(available, 0)), ResetAt: time.Unix(0, tat)}
+	if needed > 0 && int64(needed) <= capacity {
+		allowAt := tat + int64(needed)*int64(g.emission) - g.burst(capacity)
+		q.RetryAfter = time.Duration(max(allowAt-now, 0))
+	}
+	return q
+}
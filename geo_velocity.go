@@ -0,0 +1,88 @@
+package ankylogo
+
+import (
+	"math"
+	"time"
+)
+
+// Locator resolves an IP address to coordinates in degrees
+type Locator interface {
+	Locate(ip string) (latitude, longitude float64, ok bool)
+}
+
+// GeoVelocityDetector flags impossible travel: two consecutive requests of an actor
+// from places further apart than anyone could travel in the time between them.
+// It keeps the last location of each identity, an API key or a user, so it needs a
+// KeyExtractor other than IPKey: an actor that is its own IP never moves
+type GeoVelocityDetector struct {
+	// Locator resolves the IP of each event, e.g. a MaxMindLocator. Without one the detector never fires
+	Locator Locator
+	// MaxSpeed is the fastest believable travel in km/h (0 = 1000, about an airliner)
+	MaxSpeed float64
+	// MinDistance is the jump in km below which travel is never flagged (0 = 100),
+	// IP geolocation is not more accurate than that
+	MinDistance float64
+	// Memory is how long the last location of an actor is kept (0 = 24 hours)
+	Memory time.Duration
+
+	actors actorStates[geoFix]
+}
+
+// geoFix is the last known location of an actor
+type geoFix struct {
+	latitude, longitude float64
+	at                  time.Time
+}
+
+func (d *GeoVelocityDetector) Name() string {
+	return "geo_velocity"
+}
+
+func (d *GeoVelocityDetector) Observe(actor string, event RateLimitEvent) float64 {
+	if d.Locator == nil || actor == event.IP {
+		return 0
+	}
+	latitude, longitude, ok := d.Locator.Locate(event.IP)
+	if !ok {
+		return 0
+	}
+	maxSpeed := d.MaxSpeed
+	if maxSpeed <= 0 {
+		maxSpeed = 1000
+	}
+	minDistance := d.MinDistance
+	if minDistance <= 0 {
+		minDistance = 100
+	}
+	memory := d.Memory
+	if memory <= 0 {
+		memory = 24 * time.Hour
+	}
+
+	now := eventTime(event)
+	return d.actors.update(actor, now, memory, func(last *geoFix) float64 {
+		signal := 0.0
+		if !last.at.IsZero() {
+			distance := haversine(last.latitude, last.longitude, latitude, longitude)
+			hours := now.Sub(last.at).Abs().Hours()
+			if distance >= minDistance && (hours == 0 || distance/hours > maxSpeed) {
+				signal = 1
+			}
+		}
+		if !now.Before(last.at) {
+			*last = geoFix{latitude: latitude, longitude: longitude, at: now}
+		}
+		return signal
+	})
+}
+
+// haversine is the great-circle distance in km between two points given in degrees
+func haversine(lat1, lon1, lat2, lon2 float64) float64 {
+	const earthRadius = 6371.0
+	toRadians := func(degrees float64) float64 { return degrees * math.Pi / 180 }
+	dLat := toRadians(lat2 - lat1)
+	dLon := toRadians(lon2 - lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRadians(lat1))*math.Cos(toRadians(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(min(a, 1)))
+}
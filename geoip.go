@@ -0,0 +1,50 @@
+package ankylogo
+
+import (
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// MaxMindLocator resolves IPs with a local MaxMind-format database, e.g. GeoLite2-City.mmdb,
+// without any network calls. Use it as the Locator of a GeoVelocityDetector
+type MaxMindLocator struct {
+	reader *maxminddb.Reader
+}
+
+// cityRecord is the part of a city database record the locator reads
+type cityRecord struct {
+	Location struct {
+		Latitude  *float64 `maxminddb:"latitude"`
+		Longitude *float64 `maxminddb:"longitude"`
+	} `maxminddb:"location"`
+}
+
+// NewMaxMindLocator opens the .mmdb file at path. Close it when it is no longer used
+func NewMaxMindLocator(path string) (*MaxMindLocator, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &MaxMindLocator{reader: reader}, nil
+}
+
+// Locate returns the coordinates of ip, false if ip is invalid, not in the database
+// or known without coordinates (e.g. only its country)
+func (l *MaxMindLocator) Locate(ip string) (float64, float64, bool) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return 0, 0, false
+	}
+	var record cityRecord
+	_, ok, err := l.reader.LookupNetwork(parsed, &record)
+	if err != nil || !ok || record.Location.Latitude == nil || record.Location.Longitude == nil {
+		return 0, 0, false
+	}
+	return *record.Location.Latitude, *record.Location.Longitude, true
+}
+
+// Close releases the database
+func (l *MaxMindLocator) Close() error {
+	return l.reader.Close()
+}
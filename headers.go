@@ -0,0 +1,52 @@
+package ankylogo
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// setRateLimitHeaders writes the IETF RateLimit-* fields (reset as seconds from now)
+// and the legacy X-RateLimit-* ones (reset as a unix timestamp) for a quota
+func setRateLimitHeaders(c *gin.Context, q Quota) {
+	header := c.Writer.Header()
+	limit := strconv.Itoa(q.Limit)
+	remaining := strconv.Itoa(q.Remaining)
+
+	header.Set("RateLimit-Limit", limit)
+	header.Set("RateLimit-Remaining", remaining)
+	header.Set("X-RateLimit-Limit", limit)
+	header.Set("X-RateLimit-Remaining", remaining)
+	if !q.ResetAt.IsZero() {
+		header.Set("RateLimit-Reset", strconv.FormatInt(ceilSeconds(time.Until(q.ResetAt)), 10))
+		header.Set("X-RateLimit-Reset", strconv.FormatInt(q.ResetAt.Unix(), 10))
+	}
+}
+
+// setRetryAfter writes Retry-After in whole seconds, rounding up so clients never retry early
+func setRetryAfter(c *gin.Context, wait time.Duration) {
+	if wait <= 0 {
+		return
+	}
+	c.Header("Retry-After", strconv.FormatInt(ceilSeconds(wait), 10))
+}
+
+// retryAfter is how long a denied request should wait, falling back to the
+// full reset when the store couldn't tell when the request's cost fits
+func (q Quota) retryAfter() time.Duration {
+	if q.RetryAfter > 0 {
+		return q.RetryAfter
+	}
+	if !q.ResetAt.IsZero() {
+		return time.Until(q.ResetAt)
+	}
+	return 0
+}
+
+func ceilSeconds(d time.Duration) int64 {
+	if d <= 0 {
+		return 0
+	}
+	return int64((d + time.Second - 1) / time.Second)
+}
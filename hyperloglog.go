@@ -0,0 +1,86 @@
+package ankylogo
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+	"math/bits"
+	"time"
+)
+
+// hyperLogLogBits is the number of hash bits picking a register, 2^8 = 256 registers
+// for a standard error of about 6.5%, in 256 bytes however many values are added
+const hyperLogLogBits = 8
+
+// hyperLogLog estimates the number of distinct values added to it in fixed memory.
+// Each register keeps the longest run of leading zeros among the hashes that land in it
+type hyperLogLog [1 << hyperLogLogBits]uint8
+
+// add records value
+func (h *hyperLogLog) add(value string) {
+	hash := sketchHash(value)
+	register := hash >> (64 - hyperLogLogBits)
+	// the remaining bits, with a guard bit so the rank stays within 64-hyperLogLogBits+1
+	rank := uint8(bits.LeadingZeros64(hash<<hyperLogLogBits|1<<(hyperLogLogBits-1))) + 1
+	if rank > h[register] {
+		h[register] = rank
+	}
+}
+
+// merge adds every value of other
+func (h *hyperLogLog) merge(other *hyperLogLog) {
+	for i, rank := range other {
+		if rank > h[i] {
+			h[i] = rank
+		}
+	}
+}
+
+// estimate returns the approximate number of distinct values added
+func (h *hyperLogLog) estimate() float64 {
+	m := float64(len(h))
+	sum, zeros := 0.0, 0
+	for _, rank := range h {
+		sum += math.Ldexp(1, -int(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	// small counts are more accurate from the share of empty registers (linear counting)
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return estimate
+}
+
+// rollingSketch counts the distinct values of a rolling window in two halves, the current
+// and the previous one, so a value counts for between half a window and a window
+type rollingSketch struct {
+	current, previous hyperLogLog
+	start             time.Time // start of the current half
+}
+
+// add records value at now and returns the approximate number of distinct values in the window
+func (r *rollingSketch) add(value string, now time.Time, window time.Duration) float64 {
+	half := window / 2
+	switch elapsed := now.Sub(r.start); {
+	case elapsed >= window:
+		*r = rollingSketch{start: now}
+	case elapsed >= half:
+		r.previous = r.current
+		r.current = hyperLogLog{}
+		r.start = r.start.Add(half)
+	}
+	r.current.add(value)
+
+	union := r.previous
+	union.merge(&r.current)
+	return math.Round(union.estimate())
+}
+
+// sketchHash is a 64 bit hash of value, stable across processes so estimates are reproducible
+func sketchHash(value string) uint64 {
+	sum := sha256.Sum256([]byte(value))
+	return binary.BigEndian.Uint64(sum[:8])
+}
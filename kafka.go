@@ -10,11 +10,15 @@ import (
 
 type RateLimitEvent struct {
 	IP         string `json:"ip"`
+	Actor      string `json:"actor"` // identity the request was limited under (IP, hashed API key, token subject...)
 	Endpoint   string `json:"endpoint"`
-	Action     string `json:"action"` // "ALLOWED", "DENIED_WINDOW", "DENIED_BUCKET", "DENIED_RISK"
+	Path       string `json:"path,omitempty"` // raw request path, e.g. "/users/42" for the endpoint "GET /users/:id"
+	Action     string `json:"action"`         // "ALLOWED", "DENIED_WINDOW", "DENIED_BUCKET", "DENIED_RISK", "DENIED_STORE_UNAVAILABLE"
+	Dimension  string `json:"dimension"`      // name of the limit dimension that denied the request, if any
 	Timestamp  int64  `json:"timestamp"`
 	UserAgent  string `json:"useragent"`
 	StatusCode int    `json:"statuscode"`
+	Username   string `json:"username,omitempty"` // hashed username a sign-in attempt targeted, see Config.Username
 }
 
 type EventPublisher interface {
@@ -0,0 +1,100 @@
+package ankylogo
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// KeyExtractor returns the actor identity a request is rate limited under.
+// Returning false means the extractor found nothing usable on this request,
+// which lets FirstOf fall through to the next extractor.
+type KeyExtractor func(c *gin.Context) (string, bool)
+
+// IPKey identifies actors by client IP. This is the default when
+// Config.KeyExtractor is nil.
+func IPKey() KeyExtractor {
+	return func(c *gin.Context) (string, bool) {
+		return c.ClientIP(), true
+	}
+}
+
+// HeaderKey identifies actors by the value of a request header, e.g. "X-API-Key".
+// The value is hashed so raw API keys never end up in storage keys or Kafka events.
+func HeaderKey(header string) KeyExtractor {
+	return func(c *gin.Context) (string, bool) {
+		value := c.GetHeader(header)
+		if value == "" {
+			return "", false
+		}
+		return "header:" + hashIdentity(value), true
+	}
+}
+
+// CookieKey identifies actors by the value of a cookie, e.g. a session id.
+// Like HeaderKey the value is hashed before use.
+func CookieKey(name string) KeyExtractor {
+	return func(c *gin.Context) (string, bool) {
+		value, err := c.Cookie(name)
+		if err != nil || value == "" {
+			return "", false
+		}
+		return "cookie:" + hashIdentity(value), true
+	}
+}
+
+// BearerSubjectKey identifies actors by the "sub" claim of a JWT bearer token.
+// The token signature is NOT verified here, so this should only be used behind
+// an auth layer that rejects forged tokens, otherwise a client can pick its own
+// bucket by minting tokens with arbitrary subjects.
+func BearerSubjectKey() KeyExtractor {
+	return func(c *gin.Context) (string, bool) {
+		auth := c.GetHeader("Authorization")
+		token, found := strings.CutPrefix(auth, "Bearer ")
+		if !found {
+			return "", false
+		}
+		parts := strings.Split(token, ".")
+		if len(parts) != 3 {
+			return "", false
+		}
+		payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+		if err != nil {
+			return "", false
+		}
+		var claims struct {
+			Subject string `json:"sub"`
+		}
+		if err := json.Unmarshal(payload, &claims); err != nil || claims.Subject == "" {
+			return "", false
+		}
+		return "sub:" + claims.Subject, true
+	}
+}
+
+// FirstOf tries each extractor in order and returns the first identity found,
+// e.g. FirstOf(HeaderKey("X-API-Key"), IPKey()) limits by API key and falls
+// back to IP for anonymous traffic.
+func FirstOf(extractors ...KeyExtractor) KeyExtractor {
+	return func(c *gin.Context) (string, bool) {
+		for _, extract := range extractors {
+			if extract == nil {
+				continue
+			}
+			if key, ok := extract(c); ok {
+				return key, true
+			}
+		}
+		return "", false
+	}
+}
+
+// hashIdentity shortens a secret into a stable, non-reversible identifier
+func hashIdentity(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,102 @@
+package ankylogo
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// helper to build a gin context around a request so extractors can be called directly
+func newExtractorContext(req *http.Request) *gin.Context {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = req
+	return c
+}
+
+// helper to build an unsigned JWT carrying the given payload
+func fakeJWT(payload string) string {
+	return "e30." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".sig"
+}
+
+/*
+Testing that HeaderKey hashes the header value instead of using it raw
+and reports no identity when the header is missing
+*/
+func TestHeaderKey(t *testing.T) {
+	extract := HeaderKey("X-API-Key")
+
+	req, _ := http.NewRequest("GET", "/ping", nil)
+	req.Header.Set("X-API-Key", "secret-key-1")
+	key, ok := extract(newExtractorContext(req))
+	if !ok {
+		t.Fatal("HeaderKey should find an identity when the header is set")
+	}
+	if key != "header:"+hashIdentity("secret-key-1") {
+		t.Errorf("HeaderKey should return the hashed header value, got %s", key)
+	}
+
+	req, _ = http.NewRequest("GET", "/ping", nil)
+	if _, ok := extract(newExtractorContext(req)); ok {
+		t.Error("HeaderKey should report no identity when the header is missing")
+	}
+}
+
+/*
+Testing that BearerSubjectKey reads the sub claim and rejects malformed tokens
+*/
+func TestBearerSubjectKey(t *testing.T) {
+	extract := BearerSubjectKey()
+
+	req, _ := http.NewRequest("GET", "/ping", nil)
+	req.Header.Set("Authorization", "Bearer "+fakeJWT(`{"sub":"user-42"}`))
+	key, ok := extract(newExtractorContext(req))
+	if !ok || key != "sub:user-42" {
+		t.Errorf("BearerSubjectKey should return sub:user-42, got %q (ok=%v)", key, ok)
+	}
+
+	for _, auth := range []string{"", "Basic abc", "Bearer not-a-jwt", "Bearer " + fakeJWT(`{"name":"x"}`)} {
+		req, _ := http.NewRequest("GET", "/ping", nil)
+		req.Header.Set("Authorization", auth)
+		if _, ok := extract(newExtractorContext(req)); ok {
+			t.Errorf("BearerSubjectKey should report no identity for Authorization %q", auth)
+		}
+	}
+}
+
+/*
+Testing that CookieKey hashes the cookie value
+*/
+func TestCookieKey(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/ping", nil)
+	req.AddCookie(&http.Cookie{Name: "session", Value: "abc123"})
+	key, ok := CookieKey("session")(newExtractorContext(req))
+	if !ok || key != "cookie:"+hashIdentity("abc123") {
+		t.Errorf("CookieKey should return the hashed cookie value, got %q (ok=%v)", key, ok)
+	}
+}
+
+/*
+Testing FirstOf fallback order: API key wins when present, IP is used otherwise
+*/
+func TestFirstOfFallback(t *testing.T) {
+	extract := FirstOf(HeaderKey("X-API-Key"), IPKey())
+
+	req, _ := http.NewRequest("GET", "/ping", nil)
+	req.RemoteAddr = "10.1.1.1:1234"
+	req.Header.Set("X-API-Key", "tenant-a")
+	key, _ := extract(newExtractorContext(req))
+	if key != "header:"+hashIdentity("tenant-a") {
+		t.Errorf("FirstOf should prefer the API key, got %s", key)
+	}
+
+	req, _ = http.NewRequest("GET", "/ping", nil)
+	req.RemoteAddr = "10.1.1.1:1234"
+	key, _ = extract(newExtractorContext(req))
+	if key != "10.1.1.1" {
+		t.Errorf("FirstOf should fall back to the IP, got %s", key)
+	}
+}
@@ -62,9 +62,9 @@ func main() {
 func testSlidingWindowEnforcement() TestResult {
 	memoryStore := ankylogo.NewMemoryStore()
 	config := ankylogo.Config{
-		Window:     60,  // 60 second window
-		Limit:      100, // 100 requests max
-		Capacity:   0,   // Disable token bucket
+		Window:   time.Minute, // 60 second window
+		Limit:    100,         // 100 requests max
+		Capacity: 0,           // Disable token bucket
 	}
 
 	router := gin.New()
@@ -187,10 +187,10 @@ func testTokenBucketEnforcement() TestResult {
 func testDualAlgorithmUnderAttack() TestResult {
 	memoryStore := ankylogo.NewMemoryStore()
 	config := ankylogo.Config{
-		Window:            10,  // 10 second window
-		Limit:             50,  // 50 requests max
-		Capacity:          20,  // 20 token capacity
-		TokensPerInterval: 5,   // Refill 5 tokens per interval
+		Window:            10 * time.Second, // 10 second window
+		Limit:             50,               // 50 requests max
+		Capacity:          20,               // 20 token capacity
+		TokensPerInterval: 5,                // Refill 5 tokens per interval
 		RefillRate:        time.Millisecond * 100,
 	}
 
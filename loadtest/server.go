@@ -24,12 +24,12 @@ func main() {
 	routerWithMiddleware := gin.New()
 	memoryStore := ankylogo.NewMemoryStore()
 	config := ankylogo.Config{
-		Window:            60,              // 60 second window
-		Limit:             1000000,         // 1M requests per window (won't hit limit)
-		Capacity:          100000,          // 100K token capacity (won't hit limit)
-		TokensPerInterval: 10000,           // Fast refill
+		Window:            time.Minute,      // 60 second window
+		Limit:             1000000,          // 1M requests per window (won't hit limit)
+		Capacity:          100000,           // 100K token capacity (won't hit limit)
+		TokensPerInterval: 10000,            // Fast refill
 		RefillRate:        time.Millisecond, // Refill every 1ms
-		EventPublisher:    nil,             // Disable Kafka for pure middleware overhead test
+		EventPublisher:    nil,              // Disable Kafka for pure middleware overhead test
 	}
 	routerWithMiddleware.Use(ankylogo.RateLimiterMiddleware(memoryStore, config))
 	routerWithMiddleware.GET("/with-middleware", func(c *gin.Context) {
@@ -1,29 +1,406 @@
 package ankylogo
 
 import (
+	"context"
+	"hash/maphash"
+	"math/rand/v2"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+var (
+	_ DecisionStore    = (*MemoryStore)(nil)
+	_ BatchStore       = (*MemoryStore)(nil)
+	_ GCRAStore        = (*MemoryStore)(nil)
+	_ RateLimiterStore = (*MemoryStore)(nil)
+)
+
 type MemoryStore struct {
-	bucketPerIp        sync.Map
-	slidingWindowPerIP sync.Map
+	buckets limiterMap
+	windows limiterMap
+	gcras   limiterMap
+	// WindowMode picks the sliding window implementation, set it before the first request
+	WindowMode WindowMode
+
+	maxEntries int           // 0 = unbounded
+	idleTTL    time.Duration // 0 = entries never expire
+	entries    atomic.Int64  // limiters currently held across all maps
+	stop       chan struct{}
+	stopOnce   sync.Once
+}
+
+// memoryEntry is one key's limiter and when it was last used
+type memoryEntry struct {
+	limiter  any
+	lastUsed atomic.Int64 // unix nanoseconds
+}
+
+// windowLimiter is what SlidingWindowLimiter and SlidingWindowCounter have in common
+type windowLimiter interface {
+	AllowN(cost int) (bool, Quota)
+	Debit(cost int)
+	configure(window time.Duration, limit int)
+	batchLimiter
+}
+
+// batchLimiter is what every limiter offers for CheckAll
+type batchLimiter interface {
+	// peek reports whether cost fits without taking it
+	peek(cost int) (bool, Quota)
+	take(cost int) (bool, Quota)
+	// refund gives back cost that was just taken
+	refund(cost int)
+}
+
+// recoverer is implemented by every limiter the store holds
+type recoverer interface {
+	// recoveredAt is when the limiter is back at its full budget,
+	// ok is false if it never will be
+	recoveredAt() (at time.Time, ok bool)
 }
 
+// evictionSamples is how many entries are compared to pick the one to evict
+const evictionSamples = 8
+
+// NewMemoryStore returns a store that keeps every key until the process exits.
+// Use NewBoundedMemoryStore when the keys come from untrusted input such as client IPs.
 func NewMemoryStore() *MemoryStore {
-	return &MemoryStore{}
+	return &MemoryStore{stop: make(chan struct{})}
+}
+
+// NewBoundedMemoryStore returns a store holding about maxEntries limiters (0 = no bound)
+// and dropping limiters unused for idleTTL (0 = never).
+//
+// A limiter is only dropped once it is back at its full budget: the window is empty or the
+// bucket has refilled. Dropping it earlier would hand the actor a fresh budget. A bucket in
+// debt stays until it has refilled, however long that takes, and a bucket that never refills
+// (TokensPerInterval or RefillRate of 0) stays for as long as it is not full.
+// maxEntries is therefore a soft bound: when full, the least recently used recovered limiter
+// out of a small random sample is evicted, an approximation of LRU that needs no lock on the
+// request path, and if none of the sample has recovered the store grows past maxEntries.
+// Call Close to stop the background sweep of idle entries.
+func NewBoundedMemoryStore(maxEntries int, idleTTL time.Duration) *MemoryStore {
+	m := &MemoryStore{maxEntries: maxEntries, idleTTL: idleTTL, stop: make(chan struct{})}
+	if idleTTL > 0 {
+		go m.janitor(max(idleTTL/2, time.Millisecond))
+	}
+	return m
+}
+
+// Close stops the background sweep, it is safe to call more than once.
+// The store keeps working afterwards but idle entries are no longer removed.
+func (m *MemoryStore) Close() error {
+	m.stopOnce.Do(func() {
+		// a zero value MemoryStore has no channel and no sweep to stop
+		if m.stop != nil {
+			close(m.stop)
+		}
+	})
+	return nil
+}
+
+// Len returns the number of limiters held, across all algorithms
+func (m *MemoryStore) Len() int {
+	return int(m.entries.Load())
+}
+
+func (m *MemoryStore) CheckSlidingWindow(ctx context.Context, ip string, window time.Duration, limit, cost int) Decision {
+	allowed, quota := m.windowFor(ip, window, limit).AllowN(cost)
+	return Decision{Allowed: allowed, Quota: quota, Algorithm: m.WindowMode.algorithm()}
+}
+
+func (m *MemoryStore) CheckTokenBucket(ctx context.Context, ip string, capacity, tokensPerInterval int, refillRate time.Duration, cost int) Decision {
+	allowed, quota := m.bucketFor(ip, capacity, tokensPerInterval, refillRate).TakeTokens(cost)
+	return Decision{Allowed: allowed, Quota: quota, Algorithm: AlgorithmTokenBucket}
+}
+
+func (m *MemoryStore) ChargeSlidingWindow(ctx context.Context, ip string, window time.Duration, limit, cost int) error {
+	m.windowFor(ip, window, limit).Debit(cost)
+	return nil
+}
+
+func (m *MemoryStore) ChargeTokenBucket(ctx context.Context, ip string, capacity, tokensPerInterval int, refillRate time.Duration, cost int) error {
+	m.bucketFor(ip, capacity, tokensPerInterval, refillRate).DebitTokens(cost)
+	return nil
+}
+
+func (m *MemoryStore) CheckGCRA(ctx context.Context, ip string, capacity, tokensPerInterval int, refillRate time.Duration, cost int) Decision {
+	allowed, quota := m.gcraFor(ip, capacity, tokensPerInterval, refillRate).AllowN(cost)
+	return Decision{Allowed: allowed, Quota: quota, Algorithm: AlgorithmGCRA}
+}
+
+func (m *MemoryStore) ChargeGCRA(ctx context.Context, ip string, capacity, tokensPerInterval int, refillRate time.Duration, cost int) error {
+	m.gcraFor(ip, capacity, tokensPerInterval, refillRate).Debit(cost)
+	return nil
+}
+
+// CheckAll peeks at every limit first and only takes the cost from them when all of them
+// have room. A concurrent request can use up a limit in between, the limits already taken
+// from are then refunded, so nothing is charged for a denied request either way
+func (m *MemoryStore) CheckAll(ctx context.Context, limits []LimitCheck) []Decision {
+	decisions := make([]Decision, len(limits))
+	// the few limits of a request fit on the stack
+	var buf [4]batchLimiter
+	limiters := buf[:]
+	if len(limits) > len(buf) {
+		limiters = make([]batchLimiter, len(limits))
+	}
+	allowed := true
+	for i, l := range limits {
+		limiters[i], decisions[i].Algorithm = m.limiterFor(l)
+		decisions[i].Allowed, decisions[i].Quota = limiters[i].peek(l.Cost)
+		allowed = allowed && decisions[i].Allowed
+	}
+	if !allowed {
+		return decisions
+	}
+
+	for i, l := range limits {
+		decisions[i].Allowed, decisions[i].Quota = limiters[i].take(l.Cost)
+		if decisions[i].Allowed {
+			continue
+		}
+		for j := range i {
+			limiters[j].refund(limits[j].Cost)
+			_, decisions[j].Quota = limiters[j].peek(limits[j].Cost)
+		}
+		break
+	}
+	return decisions
+}
+
+// limiterFor returns the limiter a check runs against and the algorithm it reports
+func (m *MemoryStore) limiterFor(l LimitCheck) (batchLimiter, string) {
+	switch l.Algorithm {
+	case AlgorithmGCRA:
+		return m.gcraFor(l.Key, l.Capacity, l.TokensPerInterval, l.RefillRate), AlgorithmGCRA
+	case AlgorithmTokenBucket:
+		return m.bucketFor(l.Key, l.Capacity, l.TokensPerInterval, l.RefillRate), AlgorithmTokenBucket
+	default:
+		return m.windowFor(l.Key, l.Window, l.Limit), m.WindowMode.algorithm()
+	}
+}
+
+// RateLimiterStore methods
+
+func (m *MemoryStore) AllowedSlidingWindow(ip string, window time.Duration, limit, cost int) (bool, Quota, error) {
+	d := m.CheckSlidingWindow(context.Background(), ip, window, limit, cost)
+	return d.Allowed, d.Quota, d.Err
+}
+
+func (m *MemoryStore) AllowedTokenBucket(ip string, capacity, tokensPerInterval int, refillRate time.Duration, cost int) (bool, Quota, error) {
+	d := m.CheckTokenBucket(context.Background(), ip, capacity, tokensPerInterval, refillRate, cost)
+	return d.Allowed, d.Quota, d.Err
+}
+
+func (m *MemoryStore) DebitSlidingWindow(ip string, window time.Duration, limit, cost int) error {
+	return m.ChargeSlidingWindow(context.Background(), ip, window, limit, cost)
+}
+
+func (m *MemoryStore) DebitTokenBucket(ip string, capacity, tokensPerInterval int, refillRate time.Duration, cost int) error {
+	return m.ChargeTokenBucket(context.Background(), ip, capacity, tokensPerInterval, refillRate, cost)
+}
+
+// windowFor returns the sliding window of a key, created in the store's WindowMode.
+// Like bucketFor and gcraFor it applies the limits passed in to an existing window,
+// so a limit lowered at runtime (e.g. by risk scaling) takes effect on the next request
+func (m *MemoryStore) windowFor(ip string, window time.Duration, limit int) windowLimiter {
+	w, ok := m.existing(&m.windows, ip).(windowLimiter)
+	if !ok {
+		if m.WindowMode == WindowCounter {
+			w = NewSlidingWindowCounter(window, limit)
+		} else {
+			w = NewSlidingWindowLimiter(window, limit)
+		}
+		w = m.add(&m.windows, ip, w).(windowLimiter)
+	}
+	w.configure(window, limit)
+	return w
+}
+
+// bucketFor returns the token bucket of a key with the parameters passed in
+func (m *MemoryStore) bucketFor(ip string, capacity, tokensPerInterval int, refillRate time.Duration) *TokenBucket {
+	tb, ok := m.existing(&m.buckets, ip).(*TokenBucket)
+	if !ok {
+		tb = m.add(&m.buckets, ip, NewTokenBucket(capacity, tokensPerInterval, refillRate)).(*TokenBucket)
+	}
+	tb.configure(capacity, tokensPerInterval, refillRate)
+	return tb
+}
+
+// gcraFor returns the GCRA state of a key with the parameters passed in
+func (m *MemoryStore) gcraFor(ip string, capacity, tokensPerInterval int, refillRate time.Duration) *GCRA {
+	g, ok := m.existing(&m.gcras, ip).(*GCRA)
+	if !ok {
+		g = m.add(&m.gcras, ip, NewGCRA(capacity, tokensPerInterval, refillRate)).(*GCRA)
+	}
+	g.configure(capacity, tokensPerInterval, refillRate)
+	return g
+}
+
+// existing returns the limiter stored for key and marks it as used, nil if there is none.
+// This is the path of every request but an actor's first: a read lock and no allocation
+func (m *MemoryStore) existing(limiters *limiterMap, key string) any {
+	entry := limiters.shard(key).get(key)
+	if entry == nil {
+		return nil
+	}
+	entry.lastUsed.Store(time.Now().UnixNano())
+	return entry.limiter
+}
+
+// add stores fresh for key unless a concurrent request stored a limiter first, and returns
+// the one stored. Storing a new key may evict another one to stay within maxEntries
+func (m *MemoryStore) add(limiters *limiterMap, key string, fresh any) any {
+	entry := &memoryEntry{limiter: fresh}
+	entry.lastUsed.Store(time.Now().UnixNano())
+
+	stored, added := limiters.shard(key).getOrAdd(key, entry)
+	if !added {
+		stored.lastUsed.Store(time.Now().UnixNano())
+		return stored.limiter
+	}
+
+	if m.entries.Add(1) > int64(m.maxEntries) && m.maxEntries > 0 {
+		m.evict(entry)
+	}
+	return entry.limiter
 }
 
-func (m *MemoryStore) AllowedSlidingWindow(ip string, window int64, limit int) bool {
-	newWindow := NewSlidingWindowLimiter(window, limit)
-	sw, _ := m.slidingWindowPerIP.LoadOrStore(ip, newWindow)
-	slideWindow := sw.(*SlidingWindowLimiter)
-	return slideWindow.Allow()
+// recovered reports whether dropping the entry at now would change nothing for its actor
+func (e *memoryEntry) recovered(now time.Time) bool {
+	at, ok := e.limiter.(recoverer).recoveredAt()
+	return ok && !at.After(now)
 }
 
-func (m *MemoryStore) AllowedTokenBucket(ip string, capacity, tokensPerInterval int, refillRate time.Duration) bool {
-	newBucket := NewTokenBucket(capacity, tokensPerInterval, refillRate)
-	bucket, _ := m.bucketPerIp.LoadOrStore(ip, newBucket)
-	bucketToken := bucket.(*TokenBucket)
-	return bucketToken.TakeTokens()
+// evict removes the least recently used recovered entry out of a sample taken from every map.
+// The sample starts at a random shard and Go visits map keys in no particular order.
+// added is the entry just stored, which is about to be charged: it is full until then
+// and must not be picked, or its actor would be charged on a limiter no longer stored
+func (m *MemoryStore) evict(added *memoryEntry) {
+	now := time.Now()
+	var oldestShard *limiterShard
+	var oldestKey string
+	var oldestEntry *memoryEntry
+	for _, limiters := range m.maps() {
+		seen := 0
+		first := rand.N(shardCount)
+		for i := range shardCount {
+			shard := &limiters.shards[(first+i)%shardCount]
+			shard.mu.RLock()
+			for key, entry := range shard.entries {
+				if entry == added {
+					continue
+				}
+				older := oldestEntry == nil || entry.lastUsed.Load() < oldestEntry.lastUsed.Load()
+				if older && entry.recovered(now) {
+					oldestShard, oldestKey, oldestEntry = shard, key, entry
+				}
+				seen++
+				if seen == evictionSamples {
+					break
+				}
+			}
+			shard.mu.RUnlock()
+			if seen == evictionSamples {
+				break
+			}
+		}
+	}
+	if oldestEntry != nil && oldestShard.remove(oldestKey, oldestEntry) {
+		m.entries.Add(-1)
+	}
+}
+
+// janitor removes idle entries every interval until Close is called
+func (m *MemoryStore) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.sweep(time.Now().Add(-m.idleTTL))
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// sweep removes every recovered entry last used before cutoff
+func (m *MemoryStore) sweep(cutoff time.Time) {
+	now := time.Now()
+	for _, limiters := range m.maps() {
+		for i := range limiters.shards {
+			shard := &limiters.shards[i]
+			shard.mu.Lock()
+			for key, entry := range shard.entries {
+				if entry.lastUsed.Load() < cutoff.UnixNano() && entry.recovered(now) {
+					delete(shard.entries, key)
+					m.entries.Add(-1)
+				}
+			}
+			shard.mu.Unlock()
+		}
+	}
+}
+
+func (m *MemoryStore) maps() [3]*limiterMap {
+	return [3]*limiterMap{&m.buckets, &m.windows, &m.gcras}
+}
+
+// shardCount is how many shards each limiterMap is split into
+const shardCount = 64
+
+// shardSeed hashes keys to shards, the same for every store
+var shardSeed = maphash.MakeSeed()
+
+// limiterMap holds the limiters of one algorithm. The keys are spread over shards with a lock
+// each, so requests for different actors rarely share a lock and requests for a known actor
+// only take a read lock
+type limiterMap struct {
+	shards [shardCount]limiterShard
+}
+
+type limiterShard struct {
+	mu      sync.RWMutex
+	entries map[string]*memoryEntry
+}
+
+func (l *limiterMap) shard(key string) *limiterShard {
+	return &l.shards[maphash.String(shardSeed, key)%shardCount]
+}
+
+// get returns the entry of key, nil if there is none
+func (s *limiterShard) get(key string) *memoryEntry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.entries[key]
+}
+
+// getOrAdd returns the entry of key, adding fresh if there is none, and reports whether fresh was added
+func (s *limiterShard) getOrAdd(key string, fresh *memoryEntry) (*memoryEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry, ok := s.entries[key]; ok {
+		return entry, false
+	}
+	if s.entries == nil {
+		s.entries = make(map[string]*memoryEntry)
+	}
+	s.entries[key] = fresh
+	return fresh, true
+}
+
+// remove deletes the entry of key if it still is entry
+func (s *limiterShard) remove(key string, entry *memoryEntry) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.entries[key] != entry {
+		return false
+	}
+	delete(s.entries, key)
+	return true
 }
@@ -1,6 +1,8 @@
 package ankylogo
 
 import (
+	"context"
+	"fmt"
 	"testing"
 	"time"
 )
@@ -15,7 +17,7 @@ Essentially, this bucket will refill 2 tokens every second up to the capacity of
 */
 func TestFirstRequestBucket(t *testing.T) {
 	var firstBucketRequest *MemoryStore = NewMemoryStore()
-	var status bool = firstBucketRequest.AllowedTokenBucket("199.999.999", 3, 2, time.Second)
+	status, _, _ := firstBucketRequest.AllowedTokenBucket("199.999.999", 3, 2, time.Second, 1)
 	if !status {
 		t.Error()
 	}
@@ -23,12 +25,12 @@ func TestFirstRequestBucket(t *testing.T) {
 
 func TestLimitBucket(t *testing.T) {
 	var limitRequestBucket *MemoryStore = NewMemoryStore()
-	var firstStatus bool = limitRequestBucket.AllowedTokenBucket("100.000.111", 1, 0, time.Second)
+	firstStatus, _, _ := limitRequestBucket.AllowedTokenBucket("100.000.111", 1, 0, time.Second, 1)
 	if !firstStatus {
 		t.Error()
 	}
 	// This is expected to fail since its exceeding the capacity of the bucket
-	var secondStatus bool = limitRequestBucket.AllowedTokenBucket("100.000.111", 1, 0, time.Second)
+	secondStatus, _, _ := limitRequestBucket.AllowedTokenBucket("100.000.111", 1, 0, time.Second, 1)
 	if secondStatus {
 		t.Error()
 	}
@@ -43,7 +45,7 @@ The first request should always be allowed since the window is empty
 */
 func TestFirstRequestSlidingWindow(t *testing.T) {
 	var store *MemoryStore = NewMemoryStore()
-	var status bool = store.AllowedSlidingWindow("192.168.1.1", 60, 100)
+	status, _, _ := store.AllowedSlidingWindow("192.168.1.1", time.Minute, 100, 1)
 	if !status {
 		t.Error("First request should be allowed")
 	}
@@ -57,19 +59,19 @@ Making 3 requests (should all succeed), then a 4th request (should fail)
 func TestLimitSlidingWindow(t *testing.T) {
 	var store *MemoryStore = NewMemoryStore()
 	var ip string = "10.0.0.1"
-	var window int64 = 60
+	var window time.Duration = time.Minute
 	var limit int = 3
 
 	// First 3 requests should succeed
 	for i := 0; i < 3; i++ {
-		var status bool = store.AllowedSlidingWindow(ip, window, limit)
+		status, _, _ := store.AllowedSlidingWindow(ip, window, limit, 1)
 		if !status {
 			t.Errorf("Request %d should be allowed", i+1)
 		}
 	}
 
 	// 4th request should fail (exceeded limit)
-	var fourthStatus bool = store.AllowedSlidingWindow(ip, window, limit)
+	fourthStatus, _, _ := store.AllowedSlidingWindow(ip, window, limit, 1)
 	if fourthStatus {
 		t.Error("Fourth request should be denied (exceeded limit)")
 	}
@@ -84,27 +86,635 @@ The second request should succeed because the window has reset
 func TestSlidingWindowExpiry(t *testing.T) {
 	var store *MemoryStore = NewMemoryStore()
 	var ip string = "172.16.0.1"
-	var window int64 = 2 // 2 second window
+	var window time.Duration = 2 * time.Second // 2 second window
 	var limit int = 1
 
 	// First request should succeed
-	var firstStatus bool = store.AllowedSlidingWindow(ip, window, limit)
+	firstStatus, _, _ := store.AllowedSlidingWindow(ip, window, limit, 1)
 	if !firstStatus {
 		t.Error("First request should be allowed")
 	}
 
 	// Immediate second request should fail (window not expired)
-	var secondStatus bool = store.AllowedSlidingWindow(ip, window, limit)
+	secondStatus, _, _ := store.AllowedSlidingWindow(ip, window, limit, 1)
 	if secondStatus {
 		t.Error("Second request should be denied (window not expired)")
 	}
 
 	// Wait for window to expire
-	time.Sleep(time.Duration(window+1) * time.Second)
+	time.Sleep(window + time.Second)
 
 	// Third request should succeed (window has reset)
-	var thirdStatus bool = store.AllowedSlidingWindow(ip, window, limit)
+	thirdStatus, _, _ := store.AllowedSlidingWindow(ip, window, limit, 1)
 	if !thirdStatus {
 		t.Error("Third request should be allowed (window has reset)")
 	}
 }
+
+/*
+Testing weighted cost in the token bucket
+A bucket of 10 tokens with a request cost of 5 should allow exactly 2 requests,
+and a cheaper request should not be able to use tokens that were never there
+*/
+func TestWeightedCostBucket(t *testing.T) {
+	var store *MemoryStore = NewMemoryStore()
+	var ip string = "10.0.0.20"
+
+	for i := 0; i < 2; i++ {
+		if allowed, _, _ := store.AllowedTokenBucket(ip, 10, 0, time.Second, 5); !allowed {
+			t.Errorf("Request %d costing 5 should be allowed", i+1)
+		}
+	}
+	if allowed, _, _ := store.AllowedTokenBucket(ip, 10, 0, time.Second, 5); allowed {
+		t.Error("Third request costing 5 should be denied (bucket empty)")
+	}
+	if allowed, _, _ := store.AllowedTokenBucket(ip, 10, 0, time.Second, 1); allowed {
+		t.Error("A request costing 1 should be denied once the bucket is empty")
+	}
+}
+
+/*
+Testing weighted cost in the sliding window
+A limit of 5 with a request costing 3 allows one request. A second request costing 3
+is denied but one costing 2 still fits in the remaining slots
+*/
+func TestWeightedCostSlidingWindow(t *testing.T) {
+	var store *MemoryStore = NewMemoryStore()
+	var ip string = "10.0.0.21"
+
+	if allowed, _, _ := store.AllowedSlidingWindow(ip, time.Minute, 5, 3); !allowed {
+		t.Error("First request costing 3 should be allowed")
+	}
+	if allowed, _, _ := store.AllowedSlidingWindow(ip, time.Minute, 5, 3); allowed {
+		t.Error("Second request costing 3 should be denied (only 2 slots left)")
+	}
+	if allowed, _, _ := store.AllowedSlidingWindow(ip, time.Minute, 5, 2); !allowed {
+		t.Error("Request costing 2 should fit in the remaining slots")
+	}
+}
+
+/*
+Testing that debits always consume and can push the bucket and window past their limits
+*/
+func TestDebitMemoryStore(t *testing.T) {
+	var store *MemoryStore = NewMemoryStore()
+	var ip string = "10.0.0.22"
+
+	// bucket of 3: take 2, then debit 5 leaving -4, a request costing 1 is denied
+	store.AllowedTokenBucket(ip, 3, 0, time.Second, 2)
+	store.DebitTokenBucket(ip, 3, 0, time.Second, 5)
+	if allowed, _, _ := store.AllowedTokenBucket(ip, 3, 0, time.Second, 1); allowed {
+		t.Error("Request should be denied after a debit emptied the bucket")
+	}
+
+	// window of 3: debit 3 slots up front, the next request is denied
+	store.DebitSlidingWindow(ip, time.Minute, 3, 3)
+	if allowed, _, _ := store.AllowedSlidingWindow(ip, time.Minute, 3, 1); allowed {
+		t.Error("Request should be denied after a debit filled the window")
+	}
+}
+
+/*
+Testing the quota reported by the in-memory algorithms
+Bucket of 3 refilling 1 token per second: after taking 3, a denied request
+has 0 remaining and can retry within a second
+*/
+func TestMemoryQuota(t *testing.T) {
+	var store *MemoryStore = NewMemoryStore()
+	var ip string = "10.0.0.23"
+
+	_, quota, _ := store.AllowedTokenBucket(ip, 3, 1, time.Second, 1)
+	if quota.Limit != 3 || quota.Remaining != 2 {
+		t.Errorf("Quota should be 2 of 3 remaining, got %d of %d", quota.Remaining, quota.Limit)
+	}
+	store.AllowedTokenBucket(ip, 3, 1, time.Second, 1)
+	store.AllowedTokenBucket(ip, 3, 1, time.Second, 1)
+	allowed, quota, _ := store.AllowedTokenBucket(ip, 3, 1, time.Second, 1)
+	if allowed || quota.Remaining != 0 {
+		t.Errorf("4th request should be denied with 0 remaining, got allowed=%v remaining=%d", allowed, quota.Remaining)
+	}
+	if quota.RetryAfter <= 0 || quota.RetryAfter > time.Second {
+		t.Errorf("RetryAfter should be within one refill interval, got %v", quota.RetryAfter)
+	}
+
+	// window of 2: after 2 requests a denied one can retry once the oldest entry expires
+	store.AllowedSlidingWindow(ip, time.Minute, 2, 1)
+	store.AllowedSlidingWindow(ip, time.Minute, 2, 1)
+	allowed, quota, _ = store.AllowedSlidingWindow(ip, time.Minute, 2, 1)
+	if allowed || quota.Limit != 2 || quota.Remaining != 0 {
+		t.Errorf("3rd window request should be denied with 0 of 2 remaining, got allowed=%v %d of %d", allowed, quota.Remaining, quota.Limit)
+	}
+	if quota.RetryAfter < 59*time.Second || quota.RetryAfter > 61*time.Second {
+		t.Errorf("RetryAfter should be about the 60 second window, got %v", quota.RetryAfter)
+	}
+}
+
+/*
+Testing the Decision returned by the context-aware API
+It reports which algorithm decided, and the legacy methods agree with it
+*/
+func TestMemoryDecision(t *testing.T) {
+	var store *MemoryStore = NewMemoryStore()
+	var ip string = "10.0.0.24"
+	ctx := context.Background()
+
+	d := store.CheckTokenBucket(ctx, ip, 2, 1, time.Second, 1)
+	if !d.Allowed || d.Algorithm != AlgorithmTokenBucket || d.Remaining != 1 || d.Err != nil {
+		t.Errorf("First bucket check should be allowed by token_bucket with 1 remaining, got %+v", d)
+	}
+	store.ChargeTokenBucket(ctx, ip, 2, 1, time.Second, 1)
+	if allowed, _, _ := store.AllowedTokenBucket(ip, 2, 1, time.Second, 1); allowed {
+		t.Error("Legacy call should see the bucket emptied by the charge")
+	}
+
+	d = store.CheckSlidingWindow(ctx, ip, time.Minute, 1, 1)
+	if !d.Allowed || d.Algorithm != AlgorithmSlidingWindow || d.Limit != 1 {
+		t.Errorf("First window check should be allowed by sliding_window with limit 1, got %+v", d)
+	}
+
+	// a legacy store adapted into a DecisionStore gives the same answers
+	adapted := AdaptStore(legacyOnly{NewMemoryStore()})
+	d = adapted.CheckSlidingWindow(ctx, ip, time.Minute, 1, 1)
+	if !d.Allowed || d.Algorithm != AlgorithmSlidingWindow {
+		t.Errorf("Adapted store should allow the first request, got %+v", d)
+	}
+	if d = adapted.CheckSlidingWindow(ctx, ip, time.Minute, 1, 1); d.Allowed || d.Remaining != 0 {
+		t.Errorf("Adapted store should deny the second request with 0 remaining, got %+v", d)
+	}
+}
+
+// legacyOnly hides the DecisionStore methods of a MemoryStore
+type legacyOnly struct {
+	store *MemoryStore
+}
+
+func (l legacyOnly) AllowedSlidingWindow(key string, window time.Duration, limit, cost int) (bool, Quota, error) {
+	return l.store.AllowedSlidingWindow(key, window, limit, cost)
+}
+
+func (l legacyOnly) AllowedTokenBucket(key string, capacity, tokensPerInterval int, refillRate time.Duration, cost int) (bool, Quota, error) {
+	return l.store.AllowedTokenBucket(key, capacity, tokensPerInterval, refillRate, cost)
+}
+
+func (l legacyOnly) DebitSlidingWindow(key string, window time.Duration, limit, cost int) error {
+	return l.store.DebitSlidingWindow(key, window, limit, cost)
+}
+
+func (l legacyOnly) DebitTokenBucket(key string, capacity, tokensPerInterval int, refillRate time.Duration, cost int) error {
+	return l.store.DebitTokenBucket(key, capacity, tokensPerInterval, refillRate, cost)
+}
+
+/*
+Testing the sliding window counter mode of MemoryStore
+Window of 60 seconds with a limit of 5: the 6th request is denied with a retry time
+and the decision names the counter algorithm
+*/
+func TestSlidingWindowCounterLimit(t *testing.T) {
+	var store *MemoryStore = NewMemoryStore()
+	store.WindowMode = WindowCounter
+	var ip string = "10.0.0.25"
+	ctx := context.Background()
+
+	for i := 0; i < 5; i++ {
+		if d := store.CheckSlidingWindow(ctx, ip, time.Minute, 5, 1); !d.Allowed {
+			t.Errorf("Request %d should be allowed", i+1)
+		}
+	}
+	d := store.CheckSlidingWindow(ctx, ip, time.Minute, 5, 1)
+	if d.Allowed || d.Remaining != 0 || d.RetryAfter <= 0 {
+		t.Errorf("6th request should be denied with 0 remaining and a retry time, got %+v", d)
+	}
+	if d.Algorithm != AlgorithmSlidingWindowCounter {
+		t.Errorf("Decision should come from the counter, got %s", d.Algorithm)
+	}
+}
+
+/*
+Testing the weighted interpolation of the previous window
+With a one hour window fully used in the previous hour, a fraction f into the current
+hour the previous window still counts for (1-f) of the limit, so only about f*limit
+requests fit
+*/
+func TestSlidingWindowCounterInterpolation(t *testing.T) {
+	counter := NewSlidingWindowCounter(time.Hour, 100)
+	now := time.Now()
+	window := int64(time.Hour)
+	counter.start = time.Unix(0, now.UnixNano()-now.UnixNano()%window)
+	counter.previous = 100
+
+	elapsed := float64(now.UnixNano()%window) / float64(window)
+	expected := int(100 * elapsed)
+
+	allowed := 0
+	for i := 0; i < 100; i++ {
+		if counter.Allow() {
+			allowed++
+		}
+	}
+	if allowed < expected-1 || allowed > expected+1 {
+		t.Errorf("%.0f%% into the window about %d requests should fit, allowed %d", elapsed*100, expected, allowed)
+	}
+}
+
+/*
+Testing a zero window in the counter mode of MemoryStore
+A window of 0, for a new key or one that had a window of a minute, is taken as 1ns
+instead of panicking, so every request starts a window of its own
+*/
+func TestSlidingWindowCounterZeroWindow(t *testing.T) {
+	var store *MemoryStore = NewMemoryStore()
+	store.WindowMode = WindowCounter
+	ctx := context.Background()
+
+	if d := store.CheckSlidingWindow(ctx, "10.0.0.27", 0, 5, 1); !d.Allowed {
+		t.Errorf("A request in a zero window should be allowed, got %+v", d)
+	}
+
+	store.CheckSlidingWindow(ctx, "10.0.0.28", time.Minute, 5, 1)
+	if d := store.CheckSlidingWindow(ctx, "10.0.0.28", 0, 5, 1); !d.Allowed {
+		t.Errorf("A request after the window changed to 0 should be allowed, got %+v", d)
+	}
+	if err := store.ChargeSlidingWindow(ctx, "10.0.0.28", 0, 5, 1); err != nil {
+		t.Errorf("Charging a zero window should not fail, got %v", err)
+	}
+}
+
+/*
+Testing sub-second limits in memory: 5 per 500ms and a bucket refilling 1 token per 100ms
+*/
+func TestSubSecondLimits(t *testing.T) {
+	var store *MemoryStore = NewMemoryStore()
+	var ip string = "10.0.0.26"
+
+	for i := 0; i < 5; i++ {
+		store.AllowedSlidingWindow(ip, 500*time.Millisecond, 5, 1)
+	}
+	if allowed, _, _ := store.AllowedSlidingWindow(ip, 500*time.Millisecond, 5, 1); allowed {
+		t.Error("6th request within 500ms should be denied")
+	}
+
+	store.AllowedTokenBucket(ip, 2, 1, 100*time.Millisecond, 2)
+	if allowed, _, _ := store.AllowedTokenBucket(ip, 2, 1, 100*time.Millisecond, 1); allowed {
+		t.Error("Empty bucket should deny before the first 100ms refill")
+	}
+
+	time.Sleep(550 * time.Millisecond)
+
+	if allowed, _, _ := store.AllowedSlidingWindow(ip, 500*time.Millisecond, 5, 1); !allowed {
+		t.Error("Request after the 500ms window should be allowed")
+	}
+	if allowed, _, _ := store.AllowedTokenBucket(ip, 2, 1, 100*time.Millisecond, 2); !allowed {
+		t.Error("Bucket should have refilled within 550ms")
+	}
+}
+
+/*
+Testing GCRA in memory
+Burst of 3 earning back 1 token per 100ms: 3 requests pass, the 4th is denied with a
+retry-after of at most 100ms, and after waiting that long exactly one more request fits
+*/
+func TestMemoryGCRA(t *testing.T) {
+	var store *MemoryStore = NewMemoryStore()
+	var ip string = "10.0.0.27"
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if d := store.CheckGCRA(ctx, ip, 3, 1, 100*time.Millisecond, 1); !d.Allowed || d.Remaining != 2-i {
+			t.Errorf("Request %d should be allowed with %d remaining, got %+v", i+1, 2-i, d)
+		}
+	}
+	d := store.CheckGCRA(ctx, ip, 3, 1, 100*time.Millisecond, 1)
+	if d.Allowed || d.Algorithm != AlgorithmGCRA {
+		t.Errorf("4th request should be denied by gcra, got %+v", d)
+	}
+	if d.RetryAfter <= 0 || d.RetryAfter > 100*time.Millisecond {
+		t.Errorf("RetryAfter should be within one emission interval, got %v", d.RetryAfter)
+	}
+
+	time.Sleep(d.RetryAfter)
+	if d := store.CheckGCRA(ctx, ip, 3, 1, 100*time.Millisecond, 1); !d.Allowed {
+		t.Error("Request after RetryAfter should be allowed")
+	}
+	if d := store.CheckGCRA(ctx, ip, 3, 1, 100*time.Millisecond, 1); d.Allowed {
+		t.Error("Only one token should have been earned back")
+	}
+}
+
+/*
+Testing the janitor of a bounded store
+Limiters whose window has run out are dropped once they have been idle for the TTL,
+so the store goes back to holding nothing
+*/
+func TestMemoryIdleExpiry(t *testing.T) {
+	var store *MemoryStore = NewBoundedMemoryStore(0, 5*time.Millisecond)
+	defer store.Close()
+	ctx := context.Background()
+
+	for _, ip := range []string{"10.0.1.1", "10.0.1.2", "10.0.1.3"} {
+		store.CheckSlidingWindow(ctx, ip, time.Millisecond, 5, 1)
+	}
+	if store.Len() != 3 {
+		t.Errorf("Store should hold 3 limiters, got %d", store.Len())
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for store.Len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if store.Len() != 0 {
+		t.Errorf("Idle limiters should have been swept, %d left", store.Len())
+	}
+}
+
+/*
+Testing the maxEntries bound under live load
+An actor over its 1 minute window stays denied while 5 rounds of 20 new keys go through a
+store bounded to 10 limiters. Each round's 50ms windows have emptied by the next, so the
+store evicts them instead of growing with every key
+*/
+func TestMemoryMaxEntries(t *testing.T) {
+	var store *MemoryStore = NewBoundedMemoryStore(10, 0)
+	defer store.Close()
+	ctx := context.Background()
+	var ip string = "10.0.0.1"
+
+	for i := 0; i < 3; i++ {
+		store.CheckSlidingWindow(ctx, ip, time.Minute, 3, 1)
+	}
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 20; i++ {
+			store.CheckSlidingWindow(ctx, fmt.Sprintf("10.1.%d.%d", round, i), 50*time.Millisecond, 5, 1)
+		}
+		if d := store.CheckSlidingWindow(ctx, ip, time.Minute, 3, 1); d.Allowed {
+			t.Fatalf("The actor over its limit should stay denied, allowed in round %d", round+1)
+		}
+		time.Sleep(60 * time.Millisecond)
+	}
+	// the live round and the actor, plus what sampling can miss, but not all 101 keys
+	if store.Len() > 40 {
+		t.Errorf("Store should evict recovered limiters, holds %d", store.Len())
+	}
+}
+
+/*
+Testing that a new key is not evicted to make room for itself
+A store bounded to 5 is full of drained buckets when a new key arrives. Its own fresh
+bucket is the only recovered one, evicting it would let all 100 requests through
+*/
+func TestMemoryEvictionSkipsNewKey(t *testing.T) {
+	var store *MemoryStore = NewBoundedMemoryStore(5, 0)
+	defer store.Close()
+	ctx := context.Background()
+
+	for i := 0; i < 5; i++ {
+		store.CheckTokenBucket(ctx, fmt.Sprintf("10.0.4.%d", i), 1, 0, 0, 1)
+	}
+	passCount := 0
+	for i := 0; i < 100; i++ {
+		if store.CheckTokenBucket(ctx, "10.0.5.1", 1, 0, 0, 1).Allowed {
+			passCount++
+		}
+	}
+	if passCount != 1 {
+		t.Errorf("A bucket of 1 should allow 1 request, allowed %d", passCount)
+	}
+}
+
+/*
+Testing that eviction never hands out a fresh budget
+An exhausted bucket that never refills must survive a flood of other keys through a store
+bounded to 2 limiters, otherwise the actor would get through again
+*/
+func TestMemoryEvictionKeepsExhaustedBucket(t *testing.T) {
+	var store *MemoryStore = NewBoundedMemoryStore(2, 0)
+	defer store.Close()
+	ctx := context.Background()
+	var ip string = "10.0.2.1"
+
+	if d := store.CheckTokenBucket(ctx, ip, 1, 0, 0, 1); !d.Allowed {
+		t.Fatal("First request should be allowed")
+	}
+	for i := 0; i < 100; i++ {
+		store.CheckTokenBucket(ctx, fmt.Sprintf("10.0.3.%d", i), 1, 1, time.Nanosecond, 1)
+	}
+	if d := store.CheckTokenBucket(ctx, ip, 1, 0, 0, 1); d.Allowed {
+		t.Error("Exhausted bucket that never refills should still deny after other keys were evicted")
+	}
+}
+
+/*
+Testing Close
+Once closed the janitor no longer sweeps, an idle limiter stays in the store.
+Closing twice and closing a zero value store must not panic
+*/
+func TestMemoryClose(t *testing.T) {
+	var store *MemoryStore = NewBoundedMemoryStore(0, time.Millisecond)
+	if err := store.Close(); err != nil {
+		t.Errorf("Close should not fail, got %v", err)
+	}
+	store.Close()
+
+	store.CheckSlidingWindow(context.Background(), "10.0.4.1", time.Nanosecond, 5, 1)
+	time.Sleep(20 * time.Millisecond)
+	if store.Len() != 1 {
+		t.Errorf("Closed store should not sweep, got %d limiters", store.Len())
+	}
+
+	var zero MemoryStore
+	if err := zero.Close(); err != nil {
+		t.Errorf("Closing a zero value store should not fail, got %v", err)
+	}
+}
+
+/*
+Testing GCRA without refills
+With 0 tokens per interval or a 0 refill rate the bucket behaves like the token bucket:
+the burst of 2 passes, everything after it is denied and no reset time is reported
+*/
+func TestMemoryGCRANoRefill(t *testing.T) {
+	var store *MemoryStore = NewMemoryStore()
+	ctx := context.Background()
+
+	for _, params := range []struct {
+		ip                string
+		tokensPerInterval int
+		refillRate        time.Duration
+	}{{"10.0.5.1", 0, 0}, {"10.0.5.2", 0, time.Second}, {"10.0.5.3", 1, 0}} {
+		allowed := 0
+		for i := 0; i < 100; i++ {
+			if store.CheckGCRA(ctx, params.ip, 2, params.tokensPerInterval, params.refillRate, 1).Allowed {
+				allowed++
+			}
+		}
+		if allowed != 2 {
+			t.Errorf("%+v: only the burst of 2 should be allowed, got %d", params, allowed)
+		}
+		d := store.CheckGCRA(ctx, params.ip, 2, params.tokensPerInterval, params.refillRate, 1)
+		if d.Remaining != 0 || !d.ResetAt.IsZero() || d.RetryAfter != 0 {
+			t.Errorf("%+v: bucket that never refills should report no reset or retry, got %+v", params, d)
+		}
+	}
+}
+
+/*
+Testing CheckAll in memory
+A window of 5 and a bucket of 2 on different keys: the 3rd request is denied by the
+bucket and the window keeps the slot, 3 of its 5 slots are still free afterwards
+*/
+func TestMemoryCheckAll(t *testing.T) {
+	var store *MemoryStore = NewMemoryStore()
+	ctx := context.Background()
+	limits := []LimitCheck{
+		{Key: "ip:10.0.6.1", Algorithm: AlgorithmSlidingWindow, Window: time.Minute, Limit: 5, Cost: 1},
+		{Key: "apikey:tenant", Algorithm: AlgorithmTokenBucket, Capacity: 2, RefillRate: time.Minute, Cost: 1},
+	}
+
+	for i := 0; i < 2; i++ {
+		if d := store.CheckAll(ctx, limits); !d[0].Allowed || !d[1].Allowed {
+			t.Errorf("Request %d should pass both limits, got %+v", i+1, d)
+		}
+	}
+	d := store.CheckAll(ctx, limits)
+	if !d[0].Allowed || d[1].Allowed || d[1].Algorithm != AlgorithmTokenBucket {
+		t.Errorf("3rd request should be denied by the bucket only, got %+v", d)
+	}
+	if d[0].Remaining != 3 {
+		t.Errorf("Window should report 3 free slots, got %d", d[0].Remaining)
+	}
+	if d := store.CheckSlidingWindow(ctx, "ip:10.0.6.1", time.Minute, 5, 3); !d.Allowed || d.Remaining != 0 {
+		t.Errorf("Denied request should not have taken a window slot, got %+v", d)
+	}
+}
+
+/*
+Testing that a lower limit applies to an existing key
+Each algorithm is created with a limit of 10 and used twice, the same key is then checked
+with a limit of 3. The windows and the GCRA still count the 2 requests, so 1 more fits.
+The token bucket keeps the tokens it holds up to the new capacity, like RedisStore, so 3 fit
+*/
+func TestMemoryLowerLimitExistingKey(t *testing.T) {
+	ctx := context.Background()
+	counterStore := NewMemoryStore()
+	counterStore.WindowMode = WindowCounter
+	stores := map[string]*MemoryStore{
+		AlgorithmTokenBucket:          NewMemoryStore(),
+		AlgorithmGCRA:                 NewMemoryStore(),
+		AlgorithmSlidingWindow:        NewMemoryStore(),
+		AlgorithmSlidingWindowCounter: counterStore,
+	}
+	expected := map[string]int{
+		AlgorithmTokenBucket:          3,
+		AlgorithmGCRA:                 1,
+		AlgorithmSlidingWindow:        1,
+		AlgorithmSlidingWindowCounter: 1,
+	}
+	for algorithm, store := range stores {
+		check := func(limit int) Decision {
+			switch algorithm {
+			case AlgorithmTokenBucket:
+				return store.CheckTokenBucket(ctx, "10.0.7.1", limit, 1, time.Minute, 1)
+			case AlgorithmGCRA:
+				return store.CheckGCRA(ctx, "10.0.7.1", limit, 1, time.Minute, 1)
+			default:
+				return store.CheckSlidingWindow(ctx, "10.0.7.1", time.Minute, limit, 1)
+			}
+		}
+		check(10)
+		check(10)
+		passCount := 0
+		for i := 0; i < 5; i++ {
+			d := check(3)
+			if d.Limit != 3 {
+				t.Errorf("%s: should report the lower limit, got %d", algorithm, d.Limit)
+			}
+			if d.Allowed {
+				passCount++
+			}
+		}
+		if passCount != expected[algorithm] {
+			t.Errorf("%s: should allow %d requests at the lower limit, allowed %d", algorithm, expected[algorithm], passCount)
+		}
+	}
+}
+
+/*
+Testing that requests for an existing key do not allocate
+Every algorithm is used once to create the key, the following checks and charges
+should find it with a lookup and update it in place
+*/
+func TestMemoryExistingKeyNoAllocs(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	counterStore := NewMemoryStore()
+	counterStore.WindowMode = WindowCounter
+	checks := map[string]func(){
+		"token bucket": func() { store.CheckTokenBucket(ctx, "10.0.8.1", 100, 100, time.Millisecond, 1) },
+		"gcra":         func() { store.CheckGCRA(ctx, "10.0.8.1", 100, 100, time.Millisecond, 1) },
+		"window":       func() { store.CheckSlidingWindow(ctx, "10.0.8.1", time.Millisecond, 100, 1) },
+		"counter":      func() { counterStore.CheckSlidingWindow(ctx, "10.0.8.1", time.Millisecond, 100, 1) },
+		"charge":       func() { store.ChargeTokenBucket(ctx, "10.0.8.1", 100, 100, time.Millisecond, 1) },
+	}
+	for name, check := range checks {
+		check()
+		if allocs := testing.AllocsPerRun(1000, check); allocs != 0 {
+			t.Errorf("%s: existing key should not allocate, got %.1f allocs per request", name, allocs)
+		}
+	}
+}
+
+// Benchmarks of requests for an existing key, run with -benchmem to see the allocations
+
+func BenchmarkMemoryTokenBucket(b *testing.B) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	b.ReportAllocs()
+	for b.Loop() {
+		store.CheckTokenBucket(ctx, "10.0.8.2", 1000, 1000, time.Millisecond, 1)
+	}
+}
+
+func BenchmarkMemoryGCRA(b *testing.B) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	b.ReportAllocs()
+	for b.Loop() {
+		store.CheckGCRA(ctx, "10.0.8.2", 1000, 1000, time.Millisecond, 1)
+	}
+}
+
+func BenchmarkMemorySlidingWindow(b *testing.B) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	b.ReportAllocs()
+	for b.Loop() {
+		store.CheckSlidingWindow(ctx, "10.0.8.2", time.Millisecond, 1000, 1)
+	}
+}
+
+func BenchmarkMemorySlidingWindowCounter(b *testing.B) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	store.WindowMode = WindowCounter
+	b.ReportAllocs()
+	for b.Loop() {
+		store.CheckSlidingWindow(ctx, "10.0.8.2", time.Millisecond, 1000, 1)
+	}
+}
+
+// many actors on all cores, the case sharding is for
+func BenchmarkMemoryTokenBucketParallel(b *testing.B) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+	}
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			store.CheckTokenBucket(ctx, keys[i%len(keys)], 1000, 1000, time.Millisecond, 1)
+			i++
+		}
+	})
+}
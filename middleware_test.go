@@ -1,8 +1,15 @@
 package ankylogo
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -36,7 +43,7 @@ First 2 requests should pass, 3rd should be denied by the token bucket
 */
 func TestMiddlewareBothAlgorithms(t *testing.T) {
 	config := Config{
-		Window:            60,
+		Window:            time.Minute,
 		Limit:             100,
 		Capacity:          2,
 		TokensPerInterval: 0,
@@ -67,7 +74,7 @@ Sliding window allows 3 requests in a 60 second window
 */
 func TestMiddlewareSlidingWindowOnly(t *testing.T) {
 	config := Config{
-		Window: 60,
+		Window: time.Minute,
 		Limit:  3,
 		// Capacity is 0 so token bucket is skipped
 	}
@@ -143,8 +150,8 @@ type mockScoreReader struct {
 	scores map[string]int64
 }
 
-func (m *mockScoreReader) GetScore(ip string) int64 {
-	if score, ok := m.scores[ip]; ok {
+func (m *mockScoreReader) GetScore(actor string) int64 {
+	if score, ok := m.scores[actor]; ok {
 		return score
 	}
 	return 0
@@ -156,7 +163,7 @@ regardless of rate limit capacity. The request should never reach the algorithms
 */
 func TestMiddlewareRiskDenyAll(t *testing.T) {
 	config := Config{
-		Window:   60,
+		Window:   time.Minute,
 		Limit:    100,
 		Capacity: 100,
 		ScoreReader: &mockScoreReader{
@@ -244,7 +251,7 @@ Risk score should reduce the sliding window limit but NOT activate token bucket
 */
 func TestMiddlewareRiskDoesNotEnableDisabledAlgorithm(t *testing.T) {
 	config := Config{
-		Window: 60,
+		Window: time.Minute,
 		Limit:  10,
 		// Capacity is 0 — token bucket intentionally disabled
 		ScoreReader: &mockScoreReader{
@@ -269,3 +276,597 @@ func TestMiddlewareRiskDoesNotEnableDisabledAlgorithm(t *testing.T) {
 		t.Errorf("With Capacity=0 and risk score, should allow 5 requests (sliding window only), allowed %d", passCount)
 	}
 }
+
+// mock EventPublisher that records every published event
+type mockPublisher struct {
+	mu     sync.Mutex
+	events []RateLimitEvent
+}
+
+func (m *mockPublisher) Publish(event RateLimitEvent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.events = append(m.events, event)
+}
+
+func (m *mockPublisher) last() RateLimitEvent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.events[len(m.events)-1]
+}
+
+// helper to make a GET request to /ping carrying an API key header
+func makeRequestWithAPIKey(router *gin.Engine, apiKey string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/ping", nil)
+	req.Header.Set("X-API-Key", apiKey)
+	router.ServeHTTP(w, req)
+	return w
+}
+
+/*
+Testing that two tenants behind the same IP get separate buckets when
+limiting by API key. Tenant A exhausts its capacity of 2, tenant B is unaffected
+*/
+func TestMiddlewarePerAPIKeyBuckets(t *testing.T) {
+	config := Config{
+		KeyExtractor:      FirstOf(HeaderKey("X-API-Key"), IPKey()),
+		Capacity:          2,
+		TokensPerInterval: 0,
+		RefillRate:        time.Second,
+	}
+	router := setupTestRouter(config)
+
+	for i := 0; i < 2; i++ {
+		if w := makeRequestWithAPIKey(router, "tenant-a"); w.Code != http.StatusOK {
+			t.Errorf("Tenant A request %d should return 200, got %d", i+1, w.Code)
+		}
+	}
+	if w := makeRequestWithAPIKey(router, "tenant-a"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Tenant A request 3 should return 429, got %d", w.Code)
+	}
+
+	// same IP, different API key — must still have a full bucket
+	if w := makeRequestWithAPIKey(router, "tenant-b"); w.Code != http.StatusOK {
+		t.Errorf("Tenant B first request should return 200, got %d", w.Code)
+	}
+}
+
+/*
+Testing that the extracted identity is used for risk lookups and published events
+The risk score is keyed by the hashed API key, not by the shared IP
+*/
+func TestMiddlewareActorFlowsToRiskAndEvents(t *testing.T) {
+	publisher := &mockPublisher{}
+	badActor := "header:" + hashIdentity("bad-key")
+	config := Config{
+		KeyExtractor:   HeaderKey("X-API-Key"),
+		Capacity:       100,
+		EventPublisher: publisher,
+		ScoreReader: &mockScoreReader{
+			scores: map[string]int64{badActor: 10},
+		},
+		DenyScore: 10,
+	}
+	router := setupTestRouter(config)
+
+	if w := makeRequestWithAPIKey(router, "bad-key"); w.Code != http.StatusForbidden {
+		t.Errorf("Request with a high risk API key should return 403, got %d", w.Code)
+	}
+	if event := publisher.last(); event.Actor != badActor || event.Action != "DENIED_RISK" {
+		t.Errorf("Event should carry actor %s and DENIED_RISK, got %s and %s", badActor, event.Actor, event.Action)
+	}
+
+	if w := makeRequestWithAPIKey(router, "good-key"); w.Code != http.StatusOK {
+		t.Errorf("Request with a clean API key should return 200, got %d", w.Code)
+	}
+	if event := publisher.last(); event.Actor != "header:"+hashIdentity("good-key") {
+		t.Errorf("Allowed event should carry the API key actor, got %s", event.Actor)
+	}
+}
+
+/*
+Testing independent per-IP and per-API-key dimensions in one request
+The API key dimension allows 2 requests, the IP dimension allows 3.
+Tenant A is stopped by its API key limit without using an IP slot, so tenant B
+(same IP) still gets the last IP slot and only its next request is stopped by the IP limit
+*/
+func TestMiddlewareMultipleDimensions(t *testing.T) {
+	publisher := &mockPublisher{}
+	config := Config{
+		Dimensions: []Dimension{
+			{Name: "ip", KeyExtractor: IPKey(), Window: time.Minute, Limit: 3},
+			{Name: "apikey", KeyExtractor: HeaderKey("X-API-Key"), Capacity: 2, RefillRate: time.Second},
+		},
+		EventPublisher: publisher,
+	}
+	router := setupTestRouter(config)
+
+	for i := 0; i < 2; i++ {
+		if w := makeRequestWithAPIKey(router, "tenant-a"); w.Code != http.StatusOK {
+			t.Errorf("Tenant A request %d should return 200, got %d", i+1, w.Code)
+		}
+	}
+
+	// every dimension is checked before any is charged, the IP window keeps its slot
+	if w := makeRequestWithAPIKey(router, "tenant-a"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Tenant A request 3 should return 429, got %d", w.Code)
+	}
+	if event := publisher.last(); event.Dimension != "apikey" || event.Action != "DENIED_BUCKET" {
+		t.Errorf("Denial should be attributed to the apikey bucket, got %s/%s", event.Dimension, event.Action)
+	}
+
+	// the IP slot tenant A was denied with is still free for tenant B
+	if w := makeRequestWithAPIKey(router, "tenant-b"); w.Code != http.StatusOK {
+		t.Errorf("Tenant B should get the IP slot tenant A was not charged for, got %d", w.Code)
+	}
+
+	// IP window is now full, so tenant B is denied by the ip dimension
+	if w := makeRequestWithAPIKey(router, "tenant-b"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Tenant B should be denied by the shared IP limit, got %d", w.Code)
+	}
+	if event := publisher.last(); event.Dimension != "ip" || event.Action != "DENIED_WINDOW" {
+		t.Errorf("Denial should be attributed to the ip window, got %s/%s", event.Dimension, event.Action)
+	}
+}
+
+/*
+Testing that a dimension whose extractor finds no identity is skipped
+Anonymous requests carry no API key so only the IP dimension applies
+*/
+func TestMiddlewareDimensionSkippedWithoutIdentity(t *testing.T) {
+	config := Config{
+		Dimensions: []Dimension{
+			{Name: "ip", KeyExtractor: IPKey(), Window: time.Minute, Limit: 3},
+			{Name: "apikey", KeyExtractor: HeaderKey("X-API-Key"), Capacity: 1, RefillRate: time.Second},
+		},
+	}
+	router := setupTestRouter(config)
+
+	passCount := 0
+	for i := 0; i < 5; i++ {
+		if w := makeRequest(router); w.Code == http.StatusOK {
+			passCount++
+		}
+	}
+	if passCount != 3 {
+		t.Errorf("Anonymous requests should only be limited by the ip dimension (3), allowed %d", passCount)
+	}
+}
+
+/*
+Testing per-endpoint cost through the policies map
+POST /purchase costs 5 out of a bucket of 10, so only 2 purchases go through,
+while GET /ping keeps the default cost of 1 with its own bucket
+*/
+func TestMiddlewareEndpointCost(t *testing.T) {
+	config := Config{Capacity: 10, RefillRate: time.Second}
+	policies := map[string]Config{
+		"POST /purchase": {Capacity: 10, RefillRate: time.Second, Cost: 5},
+	}
+	router := setupTestRouter(config, policies)
+	router.POST("/purchase", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "purchase successful"})
+	})
+
+	passCount := 0
+	for i := 0; i < 4; i++ {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/purchase", nil)
+		router.ServeHTTP(w, req)
+		if w.Code == http.StatusOK {
+			passCount++
+		}
+	}
+	if passCount != 2 {
+		t.Errorf("Purchases costing 5 from a bucket of 10 should allow 2, allowed %d", passCount)
+	}
+
+	if w := makeRequest(router); w.Code != http.StatusOK {
+		t.Errorf("GET /ping should be unaffected by purchase cost, got %d", w.Code)
+	}
+}
+
+/*
+Testing post-hoc cost on failed logins
+POST /login costs 2 from a bucket of 20, with +5 when the handler answers 401.
+Failed logins drain 7 tokens each: 20 -> 13 -> 6 -> -1, so the 4th attempt is denied,
+while successful logins from another client get the full 10 attempts
+*/
+func TestMiddlewareResponseCost(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	policy := Config{
+		Capacity:     20,
+		RefillRate:   time.Second,
+		Cost:         2,
+		ResponseCost: CostOnStatus(5, http.StatusUnauthorized),
+	}
+	router := gin.New()
+	router.Use(RateLimiterMiddleware(NewMemoryStore(), policy))
+	router.POST("/login", func(c *gin.Context) {
+		if c.GetHeader("X-Password") != "correct" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "login successful"})
+	})
+
+	login := func(remoteAddr, password string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/login", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Password", password)
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	for i := 0; i < 3; i++ {
+		if code := login("10.0.0.1:1000", "wrong"); code != http.StatusUnauthorized {
+			t.Errorf("Failed login %d should reach the handler and return 401, got %d", i+1, code)
+		}
+	}
+	if code := login("10.0.0.1:1000", "wrong"); code != http.StatusTooManyRequests {
+		t.Errorf("4th failed login should be rate limited, got %d", code)
+	}
+
+	passCount := 0
+	for i := 0; i < 12; i++ {
+		if login("10.0.0.2:1000", "correct") == http.StatusOK {
+			passCount++
+		}
+	}
+	if passCount != 10 {
+		t.Errorf("Successful logins costing 2 from a bucket of 20 should allow 10, allowed %d", passCount)
+	}
+}
+
+// mock legacy RateLimiterStore that always fails, like a RedisStore with Redis down.
+// Passed through AdaptStore so the error also checks the adapter carries it into Decision.Err
+type failingStore struct{}
+
+func (failingStore) AllowedSlidingWindow(key string, window time.Duration, limit, cost int) (bool, Quota, error) {
+	return false, Quota{}, errors.New("store unavailable")
+}
+
+func (failingStore) AllowedTokenBucket(key string, capacity, tokensPerInterval int, refillRate time.Duration, cost int) (bool, Quota, error) {
+	return false, Quota{}, errors.New("store unavailable")
+}
+
+func (failingStore) DebitSlidingWindow(key string, window time.Duration, limit, cost int) error {
+	return errors.New("store unavailable")
+}
+
+func (failingStore) DebitTokenBucket(key string, capacity, tokensPerInterval int, refillRate time.Duration, cost int) error {
+	return errors.New("store unavailable")
+}
+
+/*
+Testing fail-open vs fail-closed per endpoint when the store is down
+GET /ping is fail-open and keeps serving, POST /purchase is fail-closed
+and must be denied with 503 and a DENIED_STORE_UNAVAILABLE event
+*/
+func TestMiddlewareFailMode(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	publisher := &mockPublisher{}
+	config := Config{Capacity: 10, RefillRate: time.Second, EventPublisher: publisher}
+	policies := map[string]Config{
+		"POST /purchase": {Capacity: 10, RefillRate: time.Second, Cost: 5, FailMode: FailClosed},
+	}
+	router := gin.New()
+	router.Use(RateLimiterMiddleware(AdaptStore(failingStore{}), config, policies))
+	router.GET("/ping", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"message": "pong"})
+	})
+	router.POST("/purchase", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "purchase successful"})
+	})
+
+	if w := makeRequest(router); w.Code != http.StatusOK {
+		t.Errorf("Fail-open endpoint should keep serving when the store is down, got %d", w.Code)
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/purchase", nil)
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Fail-closed endpoint should return 503 when the store is down, got %d", w.Code)
+	}
+	if event := publisher.last(); event.Action != "DENIED_STORE_UNAVAILABLE" {
+		t.Errorf("Fail-closed denial should publish DENIED_STORE_UNAVAILABLE, got %s", event.Action)
+	}
+}
+
+// mock DecisionStore that hangs until the request's context is done, like a stuck Redis
+type hangingStore struct {
+	DecisionStore
+}
+
+func (hangingStore) CheckTokenBucket(ctx context.Context, key string, capacity, tokensPerInterval int, refillRate time.Duration, cost int) Decision {
+	<-ctx.Done()
+	return Decision{Algorithm: AlgorithmTokenBucket, Err: ctx.Err()}
+}
+
+/*
+Testing that the middleware hands the request's context to the store
+A store that only returns once the context is done must not hold a request
+with a 50ms deadline, and the fail-closed endpoint turns it into a 503
+*/
+func TestMiddlewarePassesRequestContext(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	config := Config{Capacity: 10, RefillRate: time.Second, FailMode: FailClosed}
+	router := gin.New()
+	router.Use(RateLimiterMiddleware(hangingStore{NewMemoryStore()}, config))
+	router.GET("/ping", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"message": "pong"})
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequestWithContext(ctx, "GET", "/ping", nil)
+
+	start := time.Now()
+	router.ServeHTTP(w, req)
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Request should give up when its context expires, took %v", elapsed)
+	}
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("A store timing out on a fail-closed config should return 503, got %d", w.Code)
+	}
+}
+
+/*
+Testing RateLimit headers on allowed and denied responses
+Bucket of 2 refilling 1 token per second: the first response reports 1 remaining,
+the denied 3rd response reports 0 remaining and a Retry-After of 1 second
+*/
+func TestMiddlewareRateLimitHeaders(t *testing.T) {
+	config := Config{Capacity: 2, TokensPerInterval: 1, RefillRate: time.Second}
+	router := setupTestRouter(config)
+
+	w := makeRequest(router)
+	if got := w.Header().Get("RateLimit-Limit"); got != "2" {
+		t.Errorf("RateLimit-Limit should be 2, got %q", got)
+	}
+	if got := w.Header().Get("RateLimit-Remaining"); got != "1" {
+		t.Errorf("RateLimit-Remaining should be 1, got %q", got)
+	}
+	if got := w.Header().Get("X-RateLimit-Remaining"); got != "1" {
+		t.Errorf("X-RateLimit-Remaining should be 1, got %q", got)
+	}
+	if got := w.Header().Get("RateLimit-Reset"); got != "1" {
+		t.Errorf("RateLimit-Reset should be 1 second, got %q", got)
+	}
+	if got := w.Header().Get("Retry-After"); got != "" {
+		t.Errorf("Allowed responses should not carry Retry-After, got %q", got)
+	}
+
+	makeRequest(router)
+	w = makeRequest(router)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("3rd request should be denied, got %d", w.Code)
+	}
+	if got := w.Header().Get("RateLimit-Remaining"); got != "0" {
+		t.Errorf("RateLimit-Remaining should be 0 on a denial, got %q", got)
+	}
+	if got := w.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Retry-After should be 1 second, got %q", got)
+	}
+}
+
+/*
+Testing that headers report the tightest of several limits
+The window has 10 slots and the bucket 3 tokens, so the bucket is reported
+*/
+func TestMiddlewareRateLimitHeadersTightest(t *testing.T) {
+	config := Config{Window: time.Minute, Limit: 10, Capacity: 3, RefillRate: time.Second}
+	router := setupTestRouter(config)
+
+	w := makeRequest(router)
+	if got := w.Header().Get("RateLimit-Limit"); got != "3" {
+		t.Errorf("Headers should report the bucket (limit 3), got %q", got)
+	}
+	if got := w.Header().Get("RateLimit-Remaining"); got != "2" {
+		t.Errorf("RateLimit-Remaining should be 2, got %q", got)
+	}
+}
+
+// mock ScoreReader that also knows how long until the score cools down
+type mockCooldownReader struct {
+	mockScoreReader
+	cooldown time.Duration
+}
+
+func (m *mockCooldownReader) Cooldown(actor string, score int64) time.Duration {
+	return m.cooldown
+}
+
+/*
+Testing Retry-After on a risk-based 403 when the ScoreReader can tell the cooldown
+*/
+func TestMiddlewareRiskRetryAfter(t *testing.T) {
+	config := Config{
+		Capacity: 100,
+		ScoreReader: &mockCooldownReader{
+			mockScoreReader: mockScoreReader{scores: map[string]int64{"": 10}},
+			cooldown:        90 * time.Second,
+		},
+		DenyScore: 10,
+	}
+	router := setupTestRouter(config)
+
+	w := makeRequest(router)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("Request should return 403, got %d", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "90" {
+		t.Errorf("Retry-After should be 90 seconds, got %q", got)
+	}
+}
+
+/*
+Testing GCRA selected through Config
+Burst of 2 earning back 1 token per 10 seconds: the 3rd request is denied as a bucket
+denial with a Retry-After of 10 seconds
+*/
+func TestMiddlewareGCRA(t *testing.T) {
+	publisher := &mockPublisher{}
+	config := Config{Capacity: 2, TokensPerInterval: 1, RefillRate: 10 * time.Second, BucketAlgorithm: BucketGCRA, EventPublisher: publisher}
+	router := setupTestRouter(config)
+
+	makeRequest(router)
+	makeRequest(router)
+	w := makeRequest(router)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("3rd request should be denied by GCRA, got %d", w.Code)
+	}
+	if event := publisher.last(); event.Action != "DENIED_BUCKET" {
+		t.Errorf("GCRA denial should publish DENIED_BUCKET, got %s", event.Action)
+	}
+	if got := w.Header().Get("Retry-After"); got != "10" {
+		t.Errorf("Retry-After should be 10 seconds, got %q", got)
+	}
+}
+
+/*
+Testing the warning for durations that look like seconds
+Window: 60 is 60ns since Window became a time.Duration, it is flagged whether it is on the
+config, a dimension or an endpoint policy. Real sub-second windows of 1ms and up are not
+*/
+func TestMiddlewareWarnsSubMillisecond(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	RateLimiterMiddleware(NewMemoryStore(), Config{Window: 60, Limit: 10})
+	if !strings.Contains(logged.String(), "below 1ms") {
+		t.Errorf("Window of 60ns should log a warning, got %q", logged.String())
+	}
+
+	logged.Reset()
+	RateLimiterMiddleware(NewMemoryStore(), Config{}, map[string]Config{
+		"POST /login": {Dimensions: []Dimension{{Name: "ip", Capacity: 5, TokensPerInterval: 1, RefillRate: 10}}},
+	})
+	if !strings.Contains(logged.String(), "below 1ms") {
+		t.Errorf("RefillRate of 10ns on a policy dimension should log a warning, got %q", logged.String())
+	}
+
+	logged.Reset()
+	RateLimiterMiddleware(NewMemoryStore(), Config{Window: time.Millisecond, Limit: 10, Capacity: 5, TokensPerInterval: 1, RefillRate: 500 * time.Millisecond})
+	if strings.Contains(logged.String(), "below 1ms") {
+		t.Errorf("Windows of 1ms and up should not log a warning, got %q", logged.String())
+	}
+}
+
+/*
+Testing that a risk score rising mid-stream tightens an existing bucket
+The first 2 requests pass at capacity 10, the score then reaches 50% of DenyScore:
+capacity drops to 5 and the bucket keeps only 5 of its 8 tokens
+*/
+func TestMiddlewareRiskTightensExistingBucket(t *testing.T) {
+	reader := &mockScoreReader{scores: map[string]int64{}}
+	config := Config{
+		Capacity:          10,
+		TokensPerInterval: 0,
+		RefillRate:        time.Second,
+		ScoreReader:       reader,
+		DenyScore:         10,
+	}
+	router := setupTestRouter(config)
+
+	for i := 0; i < 2; i++ {
+		if w := makeRequest(router); w.Code != http.StatusOK {
+			t.Errorf("Request %d should pass before the score rises, got %d", i+1, w.Code)
+		}
+	}
+	reader.scores[""] = 5
+	passCount := 0
+	for i := 0; i < 10; i++ {
+		if w := makeRequest(router); w.Code == http.StatusOK {
+			passCount++
+		}
+	}
+	if passCount != 5 {
+		t.Errorf("After the score rose only 5 requests should pass, allowed %d", passCount)
+	}
+}
+
+/*
+Testing usernames and raw paths on events
+The Username hook reads the username after the handler, the event carries it hashed.
+Requests without one publish no username
+*/
+func TestMiddlewareEventUsername(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	publisher := &mockPublisher{}
+	router := gin.New()
+	router.Use(RateLimiterMiddleware(NewMemoryStore(), Config{
+		Capacity:       10,
+		RefillRate:     time.Second,
+		EventPublisher: publisher,
+		Username: func(c *gin.Context) string {
+			return c.GetHeader("X-Username")
+		},
+	}))
+	router.POST("/login", func(c *gin.Context) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
+	})
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/login", nil)
+	req.Header.Set("X-Username", "alice")
+	router.ServeHTTP(w, req)
+	if event := publisher.last(); event.Username != hashIdentity("alice") || event.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected a 401 event for the hashed username, got %+v", event)
+	}
+	if event := publisher.last(); event.Path != "/login" {
+		t.Errorf("Expected the raw path on the event, got %q", event.Path)
+	}
+
+	send(router, "POST", "/login")
+	if event := publisher.last(); event.Username != "" {
+		t.Errorf("A request without a username should publish none, got %q", event.Username)
+	}
+}
+
+/*
+Testing the correlation gate in front of the middleware
+The engine's threshold and DenyScore are both 30. A single detector firing is held below
+it and not enforced at all: the bucket of 3 is not tightened. Once a second detector fires
+the actor is denied
+*/
+func TestMiddlewareRiskUncorrelated(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	engine := &RiskEngine{
+		threshold:   30,
+		decayRate:   30 * time.Minute,
+		Correlation: &CorrelationPolicy{},
+		Detectors: []WeightedDetector{
+			{Detector: endpointDetector("GET /a"), Weight: 1},
+			{Detector: endpointDetector("GET /b"), Weight: 1},
+		},
+	}
+	router := setupTestRouter(Config{
+		Capacity:    3,
+		RefillRate:  time.Minute,
+		ScoreReader: engine,
+		DenyScore:   30,
+	})
+
+	// test requests have no client IP, the actor is empty
+	engine.processEvent(RateLimitEvent{Endpoint: "GET /a", Timestamp: time.Now().UnixNano()})
+	passCount := 0
+	for i := 0; i < 3; i++ {
+		if makeRequest(router).Code == http.StatusOK {
+			passCount++
+		}
+	}
+	if passCount != 3 {
+		t.Errorf("A single detector should not tighten the bucket of 3, allowed %d", passCount)
+	}
+
+	engine.processEvent(RateLimitEvent{Endpoint: "GET /b", Timestamp: time.Now().UnixNano()})
+	if code := makeRequest(router).Code; code != http.StatusForbidden {
+		t.Errorf("Two detectors should get the actor denied, got %d", code)
+	}
+}
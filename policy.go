@@ -0,0 +1,178 @@
+package ankylogo
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Policy is a Config for the routes matching Route
+type Policy struct {
+	// Name, when set, makes every route the policy matches share one set of counters,
+	// e.g. a single budget for a whole route group. Without a name each route counts separately
+	Name string
+	// Route is "METHOD PATH", PATH being a gin route such as "/users/:id".
+	// METHOD may be "*" for any method and may be left out, PATH may end in "/*" to
+	// match a route group: "* /admin/*" matches /admin and every route below it
+	Route string
+	// Priority decides between policies matching the same route, the highest wins.
+	// Among equal priorities the most specific route wins, then the one added first
+	Priority int
+	Config   Config
+}
+
+// PolicyRegistry picks the Policy a request is limited with, or the default Config
+// when no policy matches. Use it with PolicyMiddleware
+type PolicyRegistry struct {
+	defaultConfig Config
+	routes        []policyRoute // most preferred first
+}
+
+// policyRoute is a Policy with its Route parsed
+type policyRoute struct {
+	Policy
+	method string // upper case, "*" = any
+	path   string // without the trailing "/*" of a prefix
+	prefix bool
+}
+
+// NewPolicyRegistry returns a registry applying defaultConfig to every route no policy matches.
+// The identity, risk scoring and event settings of defaultConfig (KeyExtractor, ScoreReader,
+// DenyScore, EventPublisher) apply to every request, matched by a policy or not
+func NewPolicyRegistry(defaultConfig Config, policies ...Policy) *PolicyRegistry {
+	r := &PolicyRegistry{defaultConfig: defaultConfig}
+	for _, policy := range policies {
+		r.routes = append(r.routes, parsePolicyRoute(policy))
+	}
+	sort.SliceStable(r.routes, func(i, j int) bool {
+		return r.routes[i].before(r.routes[j])
+	})
+	return r
+}
+
+// Match returns the policy for a request with method to the gin route fullPath (c.FullPath()),
+// ok is false when none matches and the default Config applies
+func (r *PolicyRegistry) Match(method, fullPath string) (policy Policy, ok bool) {
+	for _, route := range r.routes {
+		if route.matches(method, fullPath) {
+			return route.Policy, true
+		}
+	}
+	return Policy{}, false
+}
+
+// configs lists the default Config and that of every policy
+func (r *PolicyRegistry) configs() []Config {
+	configs := []Config{r.defaultConfig}
+	for _, route := range r.routes {
+		configs = append(configs, route.Config)
+	}
+	return configs
+}
+
+func parsePolicyRoute(policy Policy) policyRoute {
+	route := policyRoute{Policy: policy, method: "*"}
+	path := strings.TrimSpace(policy.Route)
+	if method, rest, found := strings.Cut(path, " "); found {
+		route.method = strings.ToUpper(method)
+		path = strings.TrimSpace(rest)
+	}
+	if path == "" || path == "*" {
+		path = "/*"
+	}
+	if strings.HasSuffix(path, "/*") {
+		route.prefix = true
+		path = strings.TrimSuffix(path, "/*")
+	}
+	route.path = path
+	return route
+}
+
+// matches reports whether the route covers a request with method to fullPath
+func (p policyRoute) matches(method, fullPath string) bool {
+	if p.method != "*" && p.method != method {
+		return false
+	}
+	if !p.prefix {
+		return fullPath == p.path
+	}
+	return fullPath == p.path || strings.HasPrefix(fullPath, p.path+"/")
+}
+
+// before reports whether p is preferred over other when both match:
+// higher priority, then an exact path, a longer prefix and a named method
+func (p policyRoute) before(other policyRoute) bool {
+	if p.Priority != other.Priority {
+		return p.Priority > other.Priority
+	}
+	if p.prefix != other.prefix {
+		return !p.prefix
+	}
+	if len(p.path) != len(other.path) {
+		return len(p.path) > len(other.path)
+	}
+	return p.method != "*" && other.method == "*"
+}
+
+// PolicyMiddleware returns a gin middleware limiting every request with the policy of its route
+// in registry, or with its default Config
+func PolicyMiddleware(store DecisionStore, registry *PolicyRegistry) gin.HandlerFunc {
+	l := newLimiter(store, registry.defaultConfig, registry.configs()...)
+	return func(c *gin.Context) {
+		c.Set(limiterContextKey, l)
+		endpoint := c.Request.Method + " " + c.FullPath()
+		policy, ok := registry.Match(c.Request.Method, c.FullPath())
+		if !ok {
+			l.handle(c, registry.defaultConfig, "", false)
+			return
+		}
+		l.handle(c, policy.Config, policy.namespace(endpoint), false)
+	}
+}
+
+// Limit returns a middleware enforcing policy on the routes it is attached to,
+// its Route is not used:
+//
+//	admin := router.Group("/admin", ankylogo.Limit(adminPolicy))
+//	router.POST("/login", ankylogo.Limit(loginPolicy), login)
+//
+// Behind a RateLimiterMiddleware or PolicyMiddleware it uses the same store, identity,
+// risk scoring and events, and its limits add to the ones already enforced there.
+// On its own it keeps its counters in a MemoryStore bounded to 100000 limiters
+// (NewBoundedMemoryStore), use LimitWith for another store
+func Limit(policy Policy) gin.HandlerFunc {
+	return LimitWith(nil, policy)
+}
+
+// LimitWith is Limit with the store used when no middleware in front provides one,
+// nil for a bounded MemoryStore
+func LimitWith(store DecisionStore, policy Policy) gin.HandlerFunc {
+	if store == nil {
+		// keys are client identities, an attacker must not be able to grow the store at will
+		store = NewBoundedMemoryStore(limitMaxEntries, 0)
+	}
+	own := newLimiter(store, policy.Config)
+	return func(c *gin.Context) {
+		l := own
+		value, nested := c.Get(limiterContextKey)
+		if nested {
+			l = value.(*limiter)
+		} else {
+			c.Set(limiterContextKey, l)
+		}
+		l.handle(c, policy.Config, policy.namespace(c.Request.Method+" "+c.FullPath()), nested)
+	}
+}
+
+// limitMaxEntries bounds the store of a Limit without one
+const limitMaxEntries = 100_000
+
+// namespace separates the counters of the policy from those of the default Config,
+// they are shared by every route when the policy has a Name
+func (p Policy) namespace(endpoint string) string {
+	if p.Name != "" {
+		return p.Name
+	}
+	return endpoint
+}
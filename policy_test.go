@@ -0,0 +1,203 @@
+package ankylogo
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// helper to send a request and return the status code
+func send(router *gin.Engine, method, path string) int {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, path, nil)
+	router.ServeHTTP(w, req)
+	return w.Code
+}
+
+// helper to register a handler answering 200
+func okHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+/*
+Testing which policy a route gets
+A higher priority wins, then an exact path over a prefix, a longer prefix over a shorter one
+and a named method over "*". Routes matched by nothing get no policy
+*/
+func TestPolicyRegistryMatch(t *testing.T) {
+	registry := NewPolicyRegistry(Config{},
+		Policy{Name: "everything", Route: "* /*"},
+		Policy{Name: "admin", Route: "* /admin/*"},
+		Policy{Name: "admin-writes", Route: "POST /admin/*"},
+		Policy{Name: "users", Route: "/admin/users/*"},
+		Policy{Name: "login", Route: "POST /login"},
+		Policy{Name: "audit", Route: "GET /admin/audit", Priority: -1},
+		Policy{Name: "lockdown", Route: "DELETE /*", Priority: 10},
+	)
+	cases := []struct {
+		method, path, expected string
+	}{
+		{"GET", "/admin", "admin"},
+		{"GET", "/admin/settings", "admin"},
+		{"POST", "/admin/settings", "admin-writes"},
+		{"GET", "/admin/users/:id", "users"},
+		{"POST", "/login", "login"},
+		{"GET", "/login", "everything"},
+		{"GET", "/administrator", "everything"},
+		{"GET", "/admin/audit", "admin"},
+		{"DELETE", "/login", "lockdown"},
+	}
+	for _, tc := range cases {
+		policy, ok := registry.Match(tc.method, tc.path)
+		if !ok || policy.Name != tc.expected {
+			t.Errorf("%s %s should match %q, got %q (matched %v)", tc.method, tc.path, tc.expected, policy.Name, ok)
+		}
+	}
+
+	if _, ok := NewPolicyRegistry(Config{}, Policy{Route: "POST /login"}).Match("GET", "/ping"); ok {
+		t.Error("GET /ping should fall back to the default config")
+	}
+}
+
+/*
+Testing a named policy on a route group
+Every route below /admin shares one bucket of 3, while /ping keeps the default bucket
+*/
+func TestPolicyMiddlewareSharedGroup(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	registry := NewPolicyRegistry(Config{Capacity: 10, RefillRate: time.Minute},
+		Policy{Name: "admin", Route: "* /admin/*", Config: Config{Capacity: 3, RefillRate: time.Minute}},
+	)
+	router := gin.New()
+	router.Use(PolicyMiddleware(NewMemoryStore(), registry))
+	router.GET("/ping", okHandler)
+	admin := router.Group("/admin")
+	admin.GET("/users", okHandler)
+	admin.POST("/settings", okHandler)
+
+	passCount := 0
+	for _, route := range [][2]string{{"GET", "/admin/users"}, {"POST", "/admin/settings"}, {"GET", "/admin/users"}, {"POST", "/admin/settings"}} {
+		if send(router, route[0], route[1]) == http.StatusOK {
+			passCount++
+		}
+	}
+	if passCount != 3 {
+		t.Errorf("Admin routes should share a bucket of 3, allowed %d", passCount)
+	}
+	if code := send(router, "GET", "/ping"); code != http.StatusOK {
+		t.Errorf("GET /ping should use the default bucket, got %d", code)
+	}
+}
+
+/*
+Testing Limit on a route group and on a single handler without any other middleware
+/admin routes share nothing without a Name: each gets a bucket of 2. /export has a bucket of 1
+*/
+func TestLimitStandalone(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/ping", okHandler)
+	admin := router.Group("/admin")
+	admin.Use(Limit(Policy{Config: Config{Capacity: 2, RefillRate: time.Minute}}))
+	admin.GET("/users", okHandler)
+	admin.GET("/settings", okHandler)
+	router.GET("/export", Limit(Policy{Config: Config{Capacity: 1, RefillRate: time.Minute}}), okHandler)
+
+	for _, path := range []string{"/admin/users", "/admin/settings"} {
+		passCount := 0
+		for i := 0; i < 3; i++ {
+			if send(router, "GET", path) == http.StatusOK {
+				passCount++
+			}
+		}
+		if passCount != 2 {
+			t.Errorf("%s should have its own bucket of 2, allowed %d", path, passCount)
+		}
+	}
+	if send(router, "GET", "/export") != http.StatusOK || send(router, "GET", "/export") != http.StatusTooManyRequests {
+		t.Error("/export should allow 1 request")
+	}
+	for i := 0; i < 5; i++ {
+		if code := send(router, "GET", "/ping"); code != http.StatusOK {
+			t.Errorf("/ping has no limit, got %d", code)
+		}
+	}
+}
+
+/*
+Testing Limit behind RateLimiterMiddleware
+The default bucket of 10 and the route's bucket of 2 both apply to /export, in the same store.
+The request denied by Limit publishes one DENIED_BUCKET event and no ALLOWED event
+*/
+func TestLimitBehindMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	publisher := &mockPublisher{}
+	store := NewMemoryStore()
+	router := gin.New()
+	router.Use(RateLimiterMiddleware(store, Config{Capacity: 10, RefillRate: time.Minute, EventPublisher: publisher}))
+	router.GET("/export", Limit(Policy{Name: "export", Config: Config{Capacity: 2, RefillRate: time.Minute}}), okHandler)
+
+	for i := 0; i < 3; i++ {
+		code := send(router, "GET", "/export")
+		if (i < 2) != (code == http.StatusOK) {
+			t.Errorf("Request %d: expected the 3rd request to be denied by the route's bucket, got %d", i+1, code)
+		}
+	}
+
+	actions := map[string]int{}
+	for _, event := range publisher.events {
+		actions[event.Action]++
+	}
+	if actions["ALLOWED"] != 2 || actions["DENIED_BUCKET"] != 1 || len(publisher.events) != 3 {
+		t.Errorf("Expected 2 ALLOWED and 1 DENIED_BUCKET events, got %v", actions)
+	}
+	// test requests have no client IP, the actor is empty
+	if d := store.CheckTokenBucket(t.Context(), ":export", 2, 0, time.Minute, 1); d.Remaining != 0 || d.Allowed {
+		t.Errorf("Limit should keep its counters in the middleware's store, got %+v", d)
+	}
+}
+
+/*
+Testing the store of a standalone Limit
+Without a store of its own Limit keeps its counters in a bounded MemoryStore
+*/
+func TestLimitDefaultStoreBounded(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var store DecisionStore
+	router := gin.New()
+	router.GET("/export", Limit(Policy{Config: Config{Capacity: 1, RefillRate: time.Minute}}), func(c *gin.Context) {
+		value, _ := c.Get(limiterContextKey)
+		store = value.(*limiter).store
+		okHandler(c)
+	})
+
+	send(router, "GET", "/export")
+	memory, ok := store.(*MemoryStore)
+	if !ok || memory.maxEntries != limitMaxEntries {
+		t.Errorf("Expected a MemoryStore bounded to %d limiters, got %T", limitMaxEntries, store)
+	}
+}
+
+/*
+Testing that equally specific routes of a policy map resolve the same way every time
+"* /admin/*" and "/admin/*" tie, the first in route order ("* /admin/*", a bucket of 1) wins
+*/
+func TestRateLimiterMiddlewarePolicyTies(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	for i := 0; i < 20; i++ {
+		router := gin.New()
+		router.Use(RateLimiterMiddleware(NewMemoryStore(), Config{Capacity: 10, RefillRate: time.Minute}, map[string]Config{
+			"* /admin/*": {Capacity: 1, RefillRate: time.Minute},
+			"/admin/*":   {Capacity: 5, RefillRate: time.Minute},
+		}))
+		router.GET("/admin/users", okHandler)
+
+		send(router, "GET", "/admin/users")
+		if code := send(router, "GET", "/admin/users"); code != http.StatusTooManyRequests {
+			t.Fatalf("Run %d: expected the bucket of 1 of \"* /admin/*\", got %d", i+1, code)
+		}
+	}
+}
@@ -4,125 +4,573 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"fmt"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
-// Lua script for sliding window rate limiting using a sorted set.
-var slidingWindowScript = `
--- KEYS[1] = the Redis key (e.g. "sliding:192.168.1.1")
--- ARGV[1] = now (current unix timestamp in nanoseconds, used as score)
--- ARGV[2] = cutoff (now - window in nanoseconds, anything older gets removed)
--- ARGV[3] = limit (max requests allowed in the window)
--- ARGV[4] = window (TTL in seconds so the key doesn't live forever)
--- ARGV[5] = unique member ID (prevents collisions when timestamps are identical)
-local key = KEYS[1]
-local now = tonumber(ARGV[1])
-local cutoff = tonumber(ARGV[2])
-local limit = tonumber(ARGV[3])
-local window = tonumber(ARGV[4])
-local member = ARGV[5]
-
-redis.call('ZREMRANGEBYSCORE', key, 0, cutoff)
-
-local count = redis.call('ZCARD', key)
-
-if count < limit then
-    redis.call('ZADD', key, now, member)
-    redis.call('EXPIRE', key, window)
-    return 1
-else
-    return 0
+// Lua script checking any number of limits in one atomic call. Every limit is evaluated
+// first, and cost is only written when all of them pass, so a request denied by one limit
+// never takes from another. Each algorithm is a function returning the state of its key:
+// ok (the cost fits), commit (take the cost), save (keep refills and rollovers) and reply.
+// It is sent by its SHA1 and only loaded again when Redis answers NOSCRIPT.
+var limitsScript = redis.NewScript(`
+-- KEYS[i] = the key of the i-th limit (e.g. "sliding:{192.168.1.1}" or "bucket:{192.168.1.1}")
+-- ARGV[1] = now (unix timestamp in nanoseconds, sliding log score)
+-- ARGV[2] = now (unix timestamp in microseconds, clock of every other algorithm)
+-- ARGV[3] = unique member ID (prevents collisions in the sliding log when timestamps are identical)
+-- ARGV[4] = mode (0 = take the cost if every limit allows it, 1 = take it regardless,
+--           used for post-response debits, 2 = dry run, take nothing)
+-- then 5 ARGVs per limit: algorithm (1 = sliding log, 2 = sliding counter, 3 = token bucket,
+-- 4 = GCRA), up to three parameters described with each function below, and the cost
+local now_ns = tonumber(ARGV[1])
+local now_us = tonumber(ARGV[2])
+local member = ARGV[3]
+local mode = tonumber(ARGV[4])
+
+-- sliding window log in a sorted set, limit and window in nanoseconds
+local function sliding_log(key, limit, window, _, cost)
+    local now = now_ns
+    redis.call('ZREMRANGEBYSCORE', key, 0, now - window)
+    local count = redis.call('ZCARD', key)
+
+    -- ms until the member at rank (0 = oldest) falls out of the window
+    local function expires_in(rank)
+        local entry = redis.call('ZRANGE', key, rank, rank, 'WITHSCORES')
+        if #entry == 0 then
+            return 0
+        end
+        return math.max(math.ceil((tonumber(entry[2]) + window - now) / 1e6), 0)
+    end
+
+    local state = {ok = count + cost <= limit}
+    function state.commit()
+        -- one member per slot, the key lives as long as the window
+        for i = 1, cost do
+            redis.call('ZADD', key, now, member .. ':' .. i)
+        end
+        redis.call('PEXPIRE', key, math.ceil(window / 1e6))
+        count = count + cost
+    end
+    function state.save()
+    end
+    function state.reply()
+        local retry = 0
+        if not state.ok and cost <= limit then
+            retry = expires_in(count + cost - limit - 1)
+        end
+        return {math.max(limit - count, 0), expires_in(-1), retry}
+    end
+    return state
 end
-`
 
-// Lua script for token bucket rate limiting using a redis hash
-var tokenBucketScript = `
--- KEYS[1] = the name of the bucket/key (e.g., "user:123:rate_limit")
--- ARGV[1] = capacity (maximum tokens allowed in the bucket)
--- ARGV[2] = refill rate (tokens per second)
--- ARGV[3] = requested tokens (usually 1)
--- ARGV[4] = current timestamp (e.g., in milliseconds or seconds)
-
-local key = KEYS[1]
-local capacity = tonumber(ARGV[1])
-local refill_rate = tonumber(ARGV[2])
-local requested_tokens = tonumber(ARGV[3])
-local current_timestamp = tonumber(ARGV[4])
-
--- Get current tokens and last refill time
-local bucket_info = redis.call("HMGET", key, "tokens", "last_refill")
-local current_tokens = tonumber(bucket_info[1])
-local last_refill = tonumber(bucket_info[2])
-
--- Initialize the bucket if it doesn't exist
-if current_tokens == nil then
-    current_tokens = capacity
-    last_refill = current_timestamp
-else
-    -- Calculate tokens to add based on time elapsed
-    local time_elapsed = current_timestamp - last_refill
-    local tokens_to_add = math.floor(time_elapsed * refill_rate)
-    
-    if tokens_to_add > 0 then
-        current_tokens = math.min(capacity, current_tokens + tokens_to_add)
-        last_refill = current_timestamp
+-- sliding window counter in a hash of three fields, limit and window in microseconds
+local function sliding_counter(key, limit, window, _, cost)
+    local now = now_us
+` + counterLua + `
+    local state = {ok = estimate() + cost <= limit, save = save}
+    function state.commit()
+        current = current + cost
     end
+    function state.reply()
+        local retry = 0
+        if not state.ok then
+            retry = retry_in(cost)
+        end
+        return {remaining(), reset_in(), retry}
+    end
+    return state
 end
 
--- Check if enough tokens are available for the request
-if current_tokens >= requested_tokens then
-    -- Consume tokens and update bucket info
-    current_tokens = current_tokens - requested_tokens
-    redis.call("HMSET", key, "tokens", current_tokens, "last_refill", last_refill)
-    -- Set/reset TTL for the key (e.g., 10 minutes) to allow cleanup of inactive clients
-    redis.call("EXPIRE", key, 600) -- Example TTL
-    return 1 -- Request allowed
-else
-    -- Not enough tokens, request denied
-    redis.call("HMSET", key, "tokens", current_tokens, "last_refill", last_refill)
-    redis.call("EXPIRE", key, 600) -- Example TTL
-    return 0 -- Request denied
+-- token bucket in a hash, capacity, tokens per interval and interval in microseconds
+local function token_bucket(bucket_key, capacity, tokens_per_interval, interval, cost)
+    local bucket_now = now_us
+` + bucketLua + `
+    local state = {ok = current_tokens >= cost, save = save_bucket}
+    function state.commit()
+        -- with mode 1 this may leave the bucket negative
+        current_tokens = current_tokens - cost
+    end
+    function state.reply()
+        local retry = 0
+        if not state.ok and cost <= capacity then
+            retry = tokens_in(cost)
+        end
+        return {math.max(current_tokens, 0), tokens_in(capacity), retry}
+    end
+    return state
+end
+
+-- GCRA, the whole state of a key is one number: its theoretical arrival time.
+-- capacity and the emission interval (microseconds to earn back one token, 0 = never)
+local function gcra(key, capacity, emission, _, cost)
+    local now = now_us
+    local state = {}
+    function state.save()
+    end
+
+    -- without refills the key holds the tokens taken instead of a TAT, the burst is all there is
+    if emission <= 0 then
+        local spent = tonumber(redis.call('GET', key)) or 0
+        state.ok = spent + cost <= capacity
+        function state.commit()
+            spent = spent + cost
+            -- same TTL as the token bucket, for cleanup of inactive clients
+            redis.call('SET', key, spent, 'EX', 600)
+        end
+        function state.reply()
+            return {math.max(capacity - spent, 0), -1, 0}
+        end
+        return state
+    end
+
+    local burst = capacity * emission
+    -- a TAT in the past means the bucket is full
+    local tat = math.max(tonumber(redis.call('GET', key)) or now, now)
+    local new_tat = tat + cost * emission
+    state.ok = now >= new_tat - burst
+    function state.commit()
+        tat = new_tat
+        -- the key is only needed until the bucket is full again
+        redis.call('SET', key, tat, 'PX', math.max(math.ceil((tat - now) / 1000), 1))
+    end
+    function state.reply()
+        local retry = 0
+        if not state.ok and cost <= capacity then
+            retry = math.max(math.ceil((new_tat - burst - now) / 1000), 0)
+        end
+        local remaining = math.max(math.floor((burst - (tat - now)) / emission), 0)
+        return {remaining, math.ceil((tat - now) / 1000), retry}
+    end
+    return state
+end
+
+local algorithms = {sliding_log, sliding_counter, token_bucket, gcra}
+local states = {}
+local all_ok = true
+for i, key in ipairs(KEYS) do
+    local arg = 4 + (i - 1) * 5
+    local algorithm = algorithms[tonumber(ARGV[arg + 1])]
+    states[i] = algorithm(key, tonumber(ARGV[arg + 2]), tonumber(ARGV[arg + 3]), tonumber(ARGV[arg + 4]),
+        tonumber(ARGV[arg + 5]))
+    all_ok = all_ok and states[i].ok
+end
+
+if mode == 1 or (mode == 0 and all_ok) then
+    for _, state in ipairs(states) do
+        state.commit()
+    end
+end
+-- refills and counter rollovers are kept either way so the clocks don't drift
+if mode ~= 2 then
+    for _, state in ipairs(states) do
+        state.save()
+    end
+end
+
+-- returns {allowed, remaining, ms until the budget is full (-1 = never), ms until a denied
+-- request fits} per limit. allowed is per limit: a passing limit reports 1 even if another
+-- one denied the request
+local reply = {}
+for _, state in ipairs(states) do
+    table.insert(reply, state.ok and 1 or 0)
+    for _, value in ipairs(state.reply()) do
+        table.insert(reply, value)
+    end
 end
+return reply
+`)
+
+// counterLua loads the sliding window counter of key into current/previous and defines its
+// helpers. Expects key, now, window and limit, times in microseconds.
+const counterLua = `
+    -- windows are aligned to the unix epoch, like the in-memory counter
+    local start = now - (now % window)
+    local counter_info = redis.call('HMGET', key, 'start', 'current', 'previous')
+    local current = tonumber(counter_info[2]) or 0
+    local previous = tonumber(counter_info[3]) or 0
+    local stored_start = tonumber(counter_info[1])
+    if stored_start ~= start then
+        if stored_start == start - window then
+            previous = current
+        else
+            previous = 0
+        end
+        current = 0
+    end
+
+    -- the previous window's count weighted by how much of it is still inside the sliding window
+    local function estimate()
+        return previous * (1 - (now - start) / window) + current
+    end
+
+    local function remaining()
+        return math.max(limit - math.ceil(estimate()), 0)
+    end
+
+    -- ms until the estimate is back to zero
+    local function reset_in()
+        if current > 0 then
+            return math.ceil((start + 2 * window - now) / 1000)
+        elseif previous > 0 then
+            return math.ceil((start + window - now) / 1000)
+        end
+        return 0
+    end
+
+    -- ms until needed slots fit
+    local function retry_in(needed)
+        if needed > limit then
+            return 0
+        end
+        local wait = 0
+        local free = limit - current - needed
+        if free >= 0 then
+            if previous == 0 then
+                return 0
+            end
+            wait = window * (1 - free / previous) - (now - start)
+        else
+            wait = window - (now - start) + window * (1 - (limit - needed) / current)
+        end
+        return math.max(math.ceil(wait / 1000), 0)
+    end
+
+    local function save()
+        redis.call('HSET', key, 'start', start, 'current', current, 'previous', previous)
+        redis.call('PEXPIRE', key, math.ceil(2 * window / 1000))
+    end
+`
+
+// bucketLua loads and refills the token bucket at bucket_key. Expects bucket_key, capacity,
+// tokens_per_interval, interval and bucket_now, times in microseconds.
+const bucketLua = `
+    -- Get current tokens and last refill time
+    local bucket_info = redis.call("HMGET", bucket_key, "tokens", "last_refill")
+    local current_tokens = tonumber(bucket_info[1])
+    local last_refill = tonumber(bucket_info[2])
+
+    -- Initialize the bucket if it doesn't exist
+    if current_tokens == nil then
+        current_tokens = capacity
+        last_refill = bucket_now
+    end
+    -- a capacity lowered since the last call (e.g. by risk scoring) applies straight away
+    current_tokens = math.min(current_tokens, capacity)
+    if tokens_per_interval > 0 and interval > 0 then
+        -- tokens are added on whole intervals after last_refill, like the in-memory TokenBucket
+        local intervals = math.floor((bucket_now - last_refill) / interval)
+        if intervals > 0 then
+            current_tokens = math.min(capacity, current_tokens + intervals * tokens_per_interval)
+            last_refill = last_refill + intervals * interval
+        end
+    end
+
+    -- ms until the bucket holds n tokens (-1 = never)
+    local function tokens_in(n)
+        if tokens_per_interval <= 0 or interval <= 0 then
+            return -1
+        end
+        local missing = math.max(n - current_tokens, 0)
+        local intervals = math.ceil(missing / tokens_per_interval)
+        return math.max(math.ceil((last_refill + intervals * interval - bucket_now) / 1000), 0)
+    end
+
+    local function save_bucket()
+        redis.call("HMSET", bucket_key, "tokens", current_tokens, "last_refill", last_refill)
+        -- Set/reset TTL for the key (10 minutes) to allow cleanup of inactive clients
+        redis.call("EXPIRE", bucket_key, 600)
+    end
 `
 
+var (
+	_ DecisionStore    = (*RedisStore)(nil)
+	_ BatchStore       = (*RedisStore)(nil)
+	_ GCRAStore        = (*RedisStore)(nil)
+	_ RateLimiterStore = (*RedisStore)(nil)
+)
+
+// DefaultRedisTimeout bounds every RedisStore call unless RedisStore.Timeout is changed
+const DefaultRedisTimeout = 100 * time.Millisecond
+
+// RedisStore keeps the rate limit state in Redis. It works with a single node, Sentinel,
+// Ring or Cluster: every key of one actor carries the actor in a hash tag, e.g.
+// "sliding:{10.0.0.1}", so all limits of one actor can be checked in one script.
 type RedisStore struct {
-	redisConnect *redis.Client
+	redisConnect redis.UniversalClient
+	// Prefix is prepended to every key to share a Redis between apps or environments,
+	// e.g. "myapp:" gives "myapp:bucket:{10.0.0.1}". Empty by default
+	Prefix string
+	// Timeout is the most a single store call may take, on top of any deadline already on
+	// the request's context. A call that runs out of time returns an error, so the middleware
+	// applies Config.FailMode instead of holding the request. Zero means no extra timeout.
+	Timeout time.Duration
+	// WindowMode picks the sliding window implementation. The log keeps a sorted set member
+	// per request, the counter a hash of three fields. They use different keys, so switching
+	// starts every actor with an empty window
+	WindowMode WindowMode
 }
 
-func NewRedisStore(client *redis.Client) *RedisStore {
-	return &RedisStore{redisConnect: client}
+// NewRedisStore accepts any go-redis client: *redis.Client, *redis.ClusterClient, *redis.Ring
+// or one built with redis.NewUniversalClient
+func NewRedisStore(client redis.UniversalClient) *RedisStore {
+	return &RedisStore{redisConnect: client, Timeout: DefaultRedisTimeout}
 }
 
-func (r *RedisStore) AllowedSlidingWindow(ip string, window int64, limit int) bool {
-	ctx := context.Background()
-	now := time.Now().UnixNano()
-	cutoff := now - (window * 1e9) // Convert window (seconds) to nanoseconds
-	key := "sliding:" + ip
+// windowKey is the key of an actor's sliding window in the store's WindowMode
+func (r *RedisStore) windowKey(id string) string {
+	if r.WindowMode == WindowCounter {
+		return r.key("counter", id)
+	}
+	return r.key("sliding", id)
+}
+
+// key builds the Redis key for one algorithm's state of an actor. The actor is wrapped
+// in a hash tag so Cluster and Ring place all of its keys on the same node
+func (r *RedisStore) key(algorithm, id string) string {
+	return r.Prefix + algorithm + ":{" + id + "}"
+}
+
+// modes of the limits script
+const (
+	scriptCheck  = iota // take the cost if every limit allows it
+	scriptCharge        // take the cost regardless
+	scriptDryRun        // take nothing
+)
+
+// algorithms of the limits script
+const (
+	scriptSlidingLog = iota + 1
+	scriptSlidingCounter
+	scriptTokenBucket
+	scriptGCRA
+)
+
+func (r *RedisStore) CheckSlidingWindow(ctx context.Context, ip string, window time.Duration, limit, cost int) Decision {
+	limits := []LimitCheck{{Key: ip, Algorithm: AlgorithmSlidingWindow, Window: window, Limit: limit, Cost: cost}}
+	return r.checkLimits(ctx, limits, scriptCheck)[0]
+}
+
+func (r *RedisStore) CheckTokenBucket(ctx context.Context, ip string, capacity, tokensPerInterval int, refillRate time.Duration, cost int) Decision {
+	limits := []LimitCheck{{Key: ip, Algorithm: AlgorithmTokenBucket, Capacity: capacity, TokensPerInterval: tokensPerInterval, RefillRate: refillRate, Cost: cost}}
+	return r.checkLimits(ctx, limits, scriptCheck)[0]
+}
+
+func (r *RedisStore) ChargeSlidingWindow(ctx context.Context, ip string, window time.Duration, limit, cost int) error {
+	limits := []LimitCheck{{Key: ip, Algorithm: AlgorithmSlidingWindow, Window: window, Limit: limit, Cost: cost}}
+	_, err := r.evalLimits(ctx, limits, scriptCharge)
+	return err
+}
+
+func (r *RedisStore) ChargeTokenBucket(ctx context.Context, ip string, capacity, tokensPerInterval int, refillRate time.Duration, cost int) error {
+	limits := []LimitCheck{{Key: ip, Algorithm: AlgorithmTokenBucket, Capacity: capacity, TokensPerInterval: tokensPerInterval, RefillRate: refillRate, Cost: cost}}
+	_, err := r.evalLimits(ctx, limits, scriptCharge)
+	return err
+}
+
+func (r *RedisStore) CheckGCRA(ctx context.Context, ip string, capacity, tokensPerInterval int, refillRate time.Duration, cost int) Decision {
+	limits := []LimitCheck{{Key: ip, Algorithm: AlgorithmGCRA, Capacity: capacity, TokensPerInterval: tokensPerInterval, RefillRate: refillRate, Cost: cost}}
+	return r.checkLimits(ctx, limits, scriptCheck)[0]
+}
+
+func (r *RedisStore) ChargeGCRA(ctx context.Context, ip string, capacity, tokensPerInterval int, refillRate time.Duration, cost int) error {
+	limits := []LimitCheck{{Key: ip, Algorithm: AlgorithmGCRA, Capacity: capacity, TokensPerInterval: tokensPerInterval, RefillRate: refillRate, Cost: cost}}
+	_, err := r.evalLimits(ctx, limits, scriptCharge)
+	return err
+}
+
+// CheckAll evaluates every limit in a single atomic script, nothing is consumed unless all
+// of them allow the request.
+//
+// With Cluster or Ring the keys of different actors (e.g. an IP and an API key) may live on
+// different nodes and can't share a script. Each actor's limits are then dry run first and
+// only charged, one script per actor, once all of them passed. A concurrent request can still
+// use up a limit between the two steps, actors charged before it are not refunded.
+func (r *RedisStore) CheckAll(ctx context.Context, limits []LimitCheck) []Decision {
+	if !r.sharded() {
+		return r.checkLimits(ctx, limits, scriptCheck)
+	}
+
+	// the limits of each actor, in order of first appearance
+	var actors []string
+	indexes := make(map[string][]int)
+	for i, l := range limits {
+		if _, ok := indexes[l.Key]; !ok {
+			actors = append(actors, l.Key)
+		}
+		indexes[l.Key] = append(indexes[l.Key], i)
+	}
+	if len(actors) <= 1 {
+		return r.checkLimits(ctx, limits, scriptCheck)
+	}
+
+	decisions := make([]Decision, len(limits))
+	// run checks every actor's limits in mode, stopping at the first actor denied.
+	// An actor whose check failed is skipped when charging, as the middleware fails open or closed on it
+	run := func(mode int) bool {
+		passed := true
+		for _, actor := range actors {
+			if mode != scriptDryRun && decisions[indexes[actor][0]].Err != nil {
+				continue
+			}
+			group := make([]LimitCheck, len(indexes[actor]))
+			for j, i := range indexes[actor] {
+				group[j] = limits[i]
+			}
+			for j, d := range r.checkLimits(ctx, group, mode) {
+				decisions[indexes[actor][j]] = d
+				passed = passed && (d.Allowed || d.Err != nil)
+			}
+			if !passed && mode != scriptDryRun {
+				return false
+			}
+		}
+		return passed
+	}
+	if run(scriptDryRun) {
+		run(scriptCheck)
+	}
+	return decisions
+}
+
+// RateLimiterStore methods
+
+func (r *RedisStore) AllowedSlidingWindow(ip string, window time.Duration, limit, cost int) (bool, Quota, error) {
+	d := r.CheckSlidingWindow(context.Background(), ip, window, limit, cost)
+	return d.Allowed, d.Quota, d.Err
+}
+
+func (r *RedisStore) AllowedTokenBucket(ip string, capacity, tokensPerInterval int, refillRate time.Duration, cost int) (bool, Quota, error) {
+	d := r.CheckTokenBucket(context.Background(), ip, capacity, tokensPerInterval, refillRate, cost)
+	return d.Allowed, d.Quota, d.Err
+}
+
+func (r *RedisStore) DebitSlidingWindow(ip string, window time.Duration, limit, cost int) error {
+	return r.ChargeSlidingWindow(context.Background(), ip, window, limit, cost)
+}
+
+func (r *RedisStore) DebitTokenBucket(ip string, capacity, tokensPerInterval int, refillRate time.Duration, cost int) error {
+	return r.ChargeTokenBucket(context.Background(), ip, capacity, tokensPerInterval, refillRate, cost)
+}
+
+// sharded reports whether the client spreads keys over several nodes
+func (r *RedisStore) sharded() bool {
+	switch r.redisConnect.(type) {
+	case *redis.ClusterClient, *redis.Ring:
+		return true
+	}
+	return false
+}
+
+// checkLimits runs the limits script and turns its reply into one decision per limit.
+// The state couldn't be read if it fails, every decision then carries the error
+func (r *RedisStore) checkLimits(ctx context.Context, limits []LimitCheck, mode int) []Decision {
+	decisions := make([]Decision, len(limits))
+	for i, l := range limits {
+		decisions[i].Algorithm = l.Algorithm
+		if !l.isBucket() {
+			decisions[i].Algorithm = r.WindowMode.algorithm()
+		}
+	}
+
+	result, err := r.evalLimits(ctx, limits, mode)
+	if err == nil && len(result) != 4*len(limits) {
+		err = fmt.Errorf("ankylogo: limits script returned %d values for %d limits", len(result), len(limits))
+	}
+	for i, l := range limits {
+		if err != nil {
+			// the caller decides whether to fail open or closed
+			decisions[i].Err = err
+			continue
+		}
+		reply := result[4*i : 4*i+4]
+		decisions[i].Allowed = reply[0] == 1
+		decisions[i].Quota = scriptQuota(l.limit(), reply)
+	}
+	return decisions
+}
+
+// evalLimits runs the limits script over the keys of the limits
+func (r *RedisStore) evalLimits(ctx context.Context, limits []LimitCheck, mode int) ([]int64, error) {
+	if len(limits) == 0 {
+		return nil, nil
+	}
+	now := time.Now()
 
 	// Generate a unique member ID to avoid collisions when timestamps are identical
 	randBytes := make([]byte, 8)
 	rand.Read(randBytes)
 	member := hex.EncodeToString(randBytes)
 
-	result, err := r.redisConnect.Eval(ctx, slidingWindowScript, []string{key}, now, cutoff, limit, window, member).Int64()
-	if err != nil {
-		// if Redis fails, fail open (allow the request)
-		return true
+	keys := make([]string, len(limits))
+	args := []interface{}{now.UnixNano(), now.UnixMicro(), member, mode}
+	for i, l := range limits {
+		switch l.Algorithm {
+		case AlgorithmGCRA:
+			keys[i] = r.key("gcra", l.Key)
+			emission := float64(gcraEmission(l.TokensPerInterval, l.RefillRate)) / float64(time.Microsecond)
+			args = append(args, scriptGCRA, l.Capacity, emission, 0, l.Cost)
+		case AlgorithmTokenBucket:
+			keys[i] = r.key("bucket", l.Key)
+			// the bucket works in microseconds, a shorter refill rate still needs to refill
+			interval := l.RefillRate.Microseconds()
+			if l.RefillRate > 0 {
+				interval = max(interval, 1)
+			}
+			args = append(args, scriptTokenBucket, l.Capacity, l.TokensPerInterval, interval, l.Cost)
+		default:
+			keys[i] = r.windowKey(l.Key)
+			if r.WindowMode == WindowCounter {
+				// the counter works in microseconds, a shorter window still needs a non-zero length
+				args = append(args, scriptSlidingCounter, l.Limit, max(l.Window.Microseconds(), 1), 0, l.Cost)
+			} else {
+				args = append(args, scriptSlidingLog, l.Limit, l.Window.Nanoseconds(), 0, l.Cost)
+			}
+		}
 	}
-	return result == 1
+	return r.eval(ctx, limitsScript, keys, args...)
 }
 
-func (r *RedisStore) AllowedTokenBucket(ip string, capacity, tokensPerInterval int, refillRate time.Duration) bool {
-	ctx := context.Background()
-	now := time.Now().Unix()
-	key := "bucket:" + ip
-	tokensPerSecond := float64(tokensPerInterval) / refillRate.Seconds()
+// eval runs a script under the store's timeout. go-redis only uses context deadlines for
+// socket reads when the client has ContextTimeoutEnabled, so the call runs in its own goroutine
+// and is abandoned once the context is done. An abandoned script may still be applied by Redis.
+func (r *RedisStore) eval(ctx context.Context, script *redis.Script, keys []string, args ...interface{}) ([]int64, error) {
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	type evalResult struct {
+		values []int64
+		err    error
+	}
+	done := make(chan evalResult, 1)
+	go func() {
+		values, err := script.Run(ctx, r.redisConnect, keys, args...).Int64Slice()
+		done <- evalResult{values: values, err: err}
+	}()
 
-	result, err := r.redisConnect.Eval(ctx, tokenBucketScript, []string{key}, capacity, tokensPerSecond, 1, now).Int64()
-	if err != nil {
-		return true
+	select {
+	case result := <-done:
+		return result.values, result.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// scriptQuota converts the {allowed, remaining, reset ms, retry ms} reply of the Lua scripts
+func scriptQuota(limit int, result []int64) Quota {
+	q := Quota{Limit: limit, Remaining: int(result[1])}
+	if result[2] >= 0 {
+		q.ResetAt = time.Now().Add(time.Duration(result[2]) * time.Millisecond)
+	}
+	if result[3] > 0 {
+		q.RetryAfter = time.Duration(result[3]) * time.Millisecond
 	}
-	return result == 1
+	return q
 }
@@ -2,20 +2,33 @@ package ankylogo
 
 import (
 	"context"
+	"errors"
+	"net"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/alicebob/miniredis/v2"
 	"github.com/redis/go-redis/v9"
 )
 
 /*
 Helper function to create a Redis client for testing
-Connects to Redis on localhost:6379 (default Docker setup)
-Returns nil if Redis is not available (tests will be skipped)
+Connects to Redis on localhost:6379 (default Docker setup) when it is running, otherwise to
+an in-process miniredis so the Lua scripts are exercised on every test run.
+Returns nil only if neither is available (tests will be skipped)
 */
 func setupRedisClient() *redis.Client {
+	addr := "localhost:6379"
+	// a plain dial fails fast, go-redis would retry a refused connection for a few seconds
+	if conn, err := net.DialTimeout("tcp", addr, 100*time.Millisecond); err == nil {
+		conn.Close()
+	} else if addr, err = inProcessRedis(); err != nil {
+		return nil
+	}
+
 	client := redis.NewClient(&redis.Options{
-		Addr:     "localhost:6379",
+		Addr:     addr,
 		Password: "",
 		DB:       0,
 	})
@@ -30,6 +43,23 @@ func setupRedisClient() *redis.Client {
 	return client
 }
 
+var (
+	miniRedisOnce sync.Once
+	miniRedis     *miniredis.Miniredis
+	miniRedisErr  error
+)
+
+// inProcessRedis starts one miniredis shared by every test of the package and returns its address
+func inProcessRedis() (string, error) {
+	miniRedisOnce.Do(func() {
+		miniRedis, miniRedisErr = miniredis.Run()
+	})
+	if miniRedisErr != nil {
+		return "", miniRedisErr
+	}
+	return miniRedis.Addr(), nil
+}
+
 // Test cases for Redis Token Bucket
 
 /*
@@ -46,7 +76,7 @@ func TestRedisFirstRequestBucket(t *testing.T) {
 
 	var store *RedisStore = NewRedisStore(client)
 	var ip string = "test-bucket-first-request"
-	var status bool = store.AllowedTokenBucket(ip, 3, 2, time.Second)
+	status, _, _ := store.AllowedTokenBucket(ip, 3, 2, time.Second, 1)
 
 	if !status {
 		t.Error("First request should be allowed")
@@ -54,7 +84,7 @@ func TestRedisFirstRequestBucket(t *testing.T) {
 
 	// Cleanup
 	ctx := context.Background()
-	client.Del(ctx, "bucket:"+ip)
+	client.Del(ctx, "bucket:{"+ip+"}")
 }
 
 /*
@@ -73,20 +103,20 @@ func TestRedisLimitBucket(t *testing.T) {
 	var ip string = "test-bucket-limit"
 
 	// First request should succeed (bucket starts at capacity 1)
-	var firstStatus bool = store.AllowedTokenBucket(ip, 1, 0, time.Second)
+	firstStatus, _, _ := store.AllowedTokenBucket(ip, 1, 0, time.Second, 1)
 	if !firstStatus {
 		t.Error("First request should be allowed")
 	}
 
 	// Second request should fail (no tokens left, no refill)
-	var secondStatus bool = store.AllowedTokenBucket(ip, 1, 0, time.Second)
+	secondStatus, _, _ := store.AllowedTokenBucket(ip, 1, 0, time.Second, 1)
 	if secondStatus {
 		t.Error("Second request should be denied (bucket empty)")
 	}
 
 	// Cleanup
 	ctx := context.Background()
-	client.Del(ctx, "bucket:"+ip)
+	client.Del(ctx, "bucket:{"+ip+"}")
 }
 
 /*
@@ -105,11 +135,11 @@ func TestRedisTokenBucketRefill(t *testing.T) {
 	var ip string = "test-bucket-refill"
 
 	// Use 2 tokens (bucket capacity is 2)
-	store.AllowedTokenBucket(ip, 2, 1, time.Second)
-	store.AllowedTokenBucket(ip, 2, 1, time.Second)
+	store.AllowedTokenBucket(ip, 2, 1, time.Second, 1)
+	store.AllowedTokenBucket(ip, 2, 1, time.Second, 1)
 
 	// Third request should fail (no tokens left)
-	var thirdStatus bool = store.AllowedTokenBucket(ip, 2, 1, time.Second)
+	thirdStatus, _, _ := store.AllowedTokenBucket(ip, 2, 1, time.Second, 1)
 	if thirdStatus {
 		t.Error("Third request should be denied (bucket empty)")
 	}
@@ -118,14 +148,14 @@ func TestRedisTokenBucketRefill(t *testing.T) {
 	time.Sleep(1 * time.Second)
 
 	// Fourth request should succeed (1 token refilled)
-	var fourthStatus bool = store.AllowedTokenBucket(ip, 2, 1, time.Second)
+	fourthStatus, _, _ := store.AllowedTokenBucket(ip, 2, 1, time.Second, 1)
 	if !fourthStatus {
 		t.Error("Fourth request should be allowed (bucket refilled)")
 	}
 
 	// Cleanup
 	ctx := context.Background()
-	client.Del(ctx, "bucket:"+ip)
+	client.Del(ctx, "bucket:{"+ip+"}")
 }
 
 // Test cases for Redis Sliding Window
@@ -144,7 +174,7 @@ func TestRedisFirstRequestSlidingWindow(t *testing.T) {
 
 	var store *RedisStore = NewRedisStore(client)
 	var ip string = "test-sliding-first"
-	var status bool = store.AllowedSlidingWindow(ip, 60, 100)
+	status, _, _ := store.AllowedSlidingWindow(ip, time.Minute, 100, 1)
 
 	if !status {
 		t.Error("First request should be allowed")
@@ -152,7 +182,7 @@ func TestRedisFirstRequestSlidingWindow(t *testing.T) {
 
 	// Cleanup
 	ctx := context.Background()
-	client.Del(ctx, "sliding:"+ip)
+	client.Del(ctx, "sliding:{"+ip+"}")
 }
 
 /*
@@ -170,30 +200,30 @@ func TestRedisLimitSlidingWindow(t *testing.T) {
 	ctx := context.Background()
 	var store *RedisStore = NewRedisStore(client)
 	var ip string = "test-sliding-limit"
-	var window int64 = 60
+	var window time.Duration = time.Minute
 	var limit int = 3
 	var status bool
 
 	// Cleanup any existing data before test and wait for it to take effect
-	client.Del(ctx, "sliding:"+ip)
+	client.Del(ctx, "sliding:{"+ip+"}")
 	time.Sleep(100 * time.Millisecond)
 
 	// First 3 requests should succeed
 	for i := 0; i < 3; i++ {
-		status = store.AllowedSlidingWindow(ip, window, limit)
+		status, _, _ = store.AllowedSlidingWindow(ip, window, limit, 1)
 		if !status {
 			t.Errorf("Request %d should be allowed", i+1)
 		}
 	}
 
 	// 4th request should fail (exceeded limit)
-	var fourthStatus bool = store.AllowedSlidingWindow(ip, window, limit)
+	fourthStatus, _, _ := store.AllowedSlidingWindow(ip, window, limit, 1)
 	if fourthStatus {
 		t.Error("Fourth request should be denied (exceeded limit)")
 	}
 
 	// Cleanup after test
-	client.Del(ctx, "sliding:"+ip)
+	client.Del(ctx, "sliding:{"+ip+"}")
 }
 
 /*
@@ -211,31 +241,579 @@ func TestRedisSlidingWindowExpiry(t *testing.T) {
 
 	var store *RedisStore = NewRedisStore(client)
 	var ip string = "test-sliding-expiry"
-	var window int64 = 2 // 2 second window
+	var window time.Duration = 2 * time.Second // 2 second window
 	var limit int = 1
 
 	// First request should succeed
-	var firstStatus bool = store.AllowedSlidingWindow(ip, window, limit)
+	firstStatus, _, _ := store.AllowedSlidingWindow(ip, window, limit, 1)
 	if !firstStatus {
 		t.Error("First request should be allowed")
 	}
 
 	// Immediate second request should fail (window not expired)
-	var secondStatus bool = store.AllowedSlidingWindow(ip, window, limit)
+	secondStatus, _, _ := store.AllowedSlidingWindow(ip, window, limit, 1)
 	if secondStatus {
 		t.Error("Second request should be denied (window not expired)")
 	}
 
 	// Wait for window to expire
-	time.Sleep(time.Duration(window+1) * time.Second)
+	time.Sleep(window + time.Second)
 
 	// Third request should succeed (window has reset)
-	var thirdStatus bool = store.AllowedSlidingWindow(ip, window, limit)
+	thirdStatus, _, _ := store.AllowedSlidingWindow(ip, window, limit, 1)
 	if !thirdStatus {
 		t.Error("Third request should be allowed (window has reset)")
 	}
 
 	// Cleanup
 	ctx := context.Background()
-	client.Del(ctx, "sliding:"+ip)
+	client.Del(ctx, "sliding:{"+ip+"}")
+}
+
+/*
+Testing weighted cost with the Redis token bucket and sliding window
+A bucket of 10 allows 2 requests costing 5, a window of 5 allows 1 request costing 3
+*/
+func TestRedisWeightedCost(t *testing.T) {
+	client := setupRedisClient()
+	if client == nil {
+		t.Skip("Redis not available, skipping test")
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	var store *RedisStore = NewRedisStore(client)
+	var ip string = "test-weighted-cost"
+	client.Del(ctx, "bucket:{"+ip+"}", "sliding:{"+ip+"}")
+
+	for i := 0; i < 2; i++ {
+		if allowed, _, _ := store.AllowedTokenBucket(ip, 10, 0, time.Second, 5); !allowed {
+			t.Errorf("Bucket request %d costing 5 should be allowed", i+1)
+		}
+	}
+	if allowed, _, _ := store.AllowedTokenBucket(ip, 10, 0, time.Second, 5); allowed {
+		t.Error("Third bucket request costing 5 should be denied")
+	}
+
+	if allowed, _, _ := store.AllowedSlidingWindow(ip, time.Minute, 5, 3); !allowed {
+		t.Error("First window request costing 3 should be allowed")
+	}
+	if allowed, _, _ := store.AllowedSlidingWindow(ip, time.Minute, 5, 3); allowed {
+		t.Error("Second window request costing 3 should be denied")
+	}
+
+	// Cleanup
+	client.Del(ctx, "bucket:{"+ip+"}", "sliding:{"+ip+"}")
+}
+
+/*
+Testing Redis debits, which consume even when the budget is already short
+*/
+func TestRedisDebit(t *testing.T) {
+	client := setupRedisClient()
+	if client == nil {
+		t.Skip("Redis not available, skipping test")
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	var store *RedisStore = NewRedisStore(client)
+	var ip string = "test-debit"
+	client.Del(ctx, "bucket:{"+ip+"}", "sliding:{"+ip+"}")
+
+	store.AllowedTokenBucket(ip, 3, 0, time.Second, 2)
+	store.DebitTokenBucket(ip, 3, 0, time.Second, 5)
+	if allowed, _, _ := store.AllowedTokenBucket(ip, 3, 0, time.Second, 1); allowed {
+		t.Error("Request should be denied after a debit emptied the bucket")
+	}
+
+	store.DebitSlidingWindow(ip, time.Minute, 3, 3)
+	if allowed, _, _ := store.AllowedSlidingWindow(ip, time.Minute, 3, 1); allowed {
+		t.Error("Request should be denied after a debit filled the window")
+	}
+
+	// Cleanup
+	client.Del(ctx, "bucket:{"+ip+"}", "sliding:{"+ip+"}")
+}
+
+/*
+Testing that Redis errors are surfaced instead of silently allowing the request
+Points the store at a port nothing listens on, so this runs without Redis
+*/
+func TestRedisUnavailableReturnsError(t *testing.T) {
+	client := redis.NewClient(&redis.Options{
+		Addr:        "localhost:1",
+		DialTimeout: 100 * time.Millisecond,
+		MaxRetries:  -1,
+	})
+	defer client.Close()
+
+	var store *RedisStore = NewRedisStore(client)
+
+	if _, _, err := store.AllowedSlidingWindow("test-unavailable", time.Minute, 10, 1); err == nil {
+		t.Error("AllowedSlidingWindow should return an error when Redis is unreachable")
+	}
+	if _, _, err := store.AllowedTokenBucket("test-unavailable", 10, 1, time.Second, 1); err == nil {
+		t.Error("AllowedTokenBucket should return an error when Redis is unreachable")
+	}
+}
+
+/*
+Testing the quota reported by the Redis scripts
+*/
+func TestRedisQuota(t *testing.T) {
+	client := setupRedisClient()
+	if client == nil {
+		t.Skip("Redis not available, skipping test")
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	var store *RedisStore = NewRedisStore(client)
+	var ip string = "test-quota"
+	client.Del(ctx, "bucket:{"+ip+"}", "sliding:{"+ip+"}")
+
+	_, quota, _ := store.AllowedTokenBucket(ip, 3, 1, time.Second, 1)
+	if quota.Limit != 3 || quota.Remaining != 2 {
+		t.Errorf("Quota should be 2 of 3 remaining, got %d of %d", quota.Remaining, quota.Limit)
+	}
+
+	store.AllowedSlidingWindow(ip, time.Minute, 2, 1)
+	store.AllowedSlidingWindow(ip, time.Minute, 2, 1)
+	allowed, quota, _ := store.AllowedSlidingWindow(ip, time.Minute, 2, 1)
+	if allowed || quota.Remaining != 0 {
+		t.Errorf("3rd window request should be denied with 0 remaining, got allowed=%v remaining=%d", allowed, quota.Remaining)
+	}
+	if quota.RetryAfter < 59*time.Second || quota.RetryAfter > 61*time.Second {
+		t.Errorf("RetryAfter should be about the 60 second window, got %v", quota.RetryAfter)
+	}
+
+	// Cleanup
+	client.Del(ctx, "bucket:{"+ip+"}", "sliding:{"+ip+"}")
+}
+
+/*
+Testing that a hung Redis turns into a fast error instead of stalling the request
+The listener accepts connections but never answers, like a Redis stuck on a slow command.
+Runs without Redis
+*/
+func TestRedisTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not open a listener: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	client := redis.NewClient(&redis.Options{Addr: listener.Addr().String(), MaxRetries: -1})
+	defer client.Close()
+
+	var store *RedisStore = NewRedisStore(client)
+	store.Timeout = 50 * time.Millisecond
+
+	start := time.Now()
+	d := store.CheckTokenBucket(context.Background(), "test-timeout", 10, 1, time.Second, 1)
+	if !errors.Is(d.Err, context.DeadlineExceeded) {
+		t.Errorf("A call to a hung Redis should fail with a deadline error, got %v", d.Err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Call should give up after the 50ms timeout, took %v", elapsed)
+	}
+
+	// a request whose client already went away doesn't reach Redis at all
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if d := store.CheckSlidingWindow(ctx, "test-timeout", time.Minute, 10, 1); !errors.Is(d.Err, context.Canceled) {
+		t.Errorf("A canceled request should fail with context.Canceled, got %v", d.Err)
+	}
+}
+
+// windowAndBucket is the pair of limits a dimension with both algorithms is checked against
+func windowAndBucket(key string, window time.Duration, limit, capacity, tokensPerInterval int, refillRate time.Duration) []LimitCheck {
+	return []LimitCheck{
+		{Key: key, Algorithm: AlgorithmSlidingWindow, Window: window, Limit: limit, Cost: 1},
+		{Key: key, Algorithm: AlgorithmTokenBucket, Capacity: capacity, TokensPerInterval: tokensPerInterval, RefillRate: refillRate, Cost: 1},
+	}
+}
+
+/*
+Testing the limits script commits nothing unless every limit allows the request
+Window of 5 with a bucket of 2: the 3rd request is denied by the bucket and must not
+take a window slot. Window of 2 with a bucket of 5: the 3rd request is denied by the
+window and must not take a token
+*/
+func TestRedisCheckAllAtomic(t *testing.T) {
+	client := setupRedisClient()
+	if client == nil {
+		t.Skip("Redis not available, skipping test")
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	var store *RedisStore = NewRedisStore(client)
+	var ip string = "test-combined"
+	client.Del(ctx, "bucket:{"+ip+"}", "sliding:{"+ip+"}")
+
+	for i := 0; i < 3; i++ {
+		store.CheckAll(ctx, windowAndBucket(ip, time.Minute, 5, 2, 0, time.Second))
+	}
+	decisions := store.CheckAll(ctx, windowAndBucket(ip, time.Minute, 5, 2, 0, time.Second))
+	window, bucket := decisions[0], decisions[1]
+	if !window.Allowed || bucket.Allowed || bucket.Algorithm != AlgorithmTokenBucket {
+		t.Errorf("Bucket should deny while the window has room, got window=%v bucket=%v", window.Allowed, bucket.Allowed)
+	}
+	if slots := client.ZCard(ctx, "sliding:{"+ip+"}").Val(); slots != 2 {
+		t.Errorf("Requests denied by the bucket should not take window slots, window holds %d want 2", slots)
+	}
+	client.Del(ctx, "bucket:{"+ip+"}", "sliding:{"+ip+"}")
+
+	for i := 0; i < 3; i++ {
+		store.CheckAll(ctx, windowAndBucket(ip, time.Minute, 2, 5, 0, time.Second))
+	}
+	decisions = store.CheckAll(ctx, windowAndBucket(ip, time.Minute, 2, 5, 0, time.Second))
+	window, bucket = decisions[0], decisions[1]
+	if window.Allowed || !bucket.Allowed || bucket.Remaining != 3 {
+		t.Errorf("Window should deny with the bucket untouched at 3 tokens, got window=%v bucket=%v remaining=%d", window.Allowed, bucket.Allowed, bucket.Remaining)
+	}
+
+	// Cleanup
+	client.Del(ctx, "bucket:{"+ip+"}", "sliding:{"+ip+"}")
+}
+
+/*
+Testing key layout: the prefix namespaces every key and the actor sits in a hash tag
+so all keys of one actor land on the same Cluster slot
+*/
+func TestRedisKeyPrefixAndHashTag(t *testing.T) {
+	client := setupRedisClient()
+	if client == nil {
+		t.Skip("Redis not available, skipping test")
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	var store *RedisStore = NewRedisStore(client)
+	store.Prefix = "ankylotest:"
+	var ip string = "test-prefix"
+	windowKey, bucketKey := "ankylotest:sliding:{"+ip+"}", "ankylotest:bucket:{"+ip+"}"
+	client.Del(ctx, windowKey, bucketKey)
+
+	store.CheckAll(ctx, windowAndBucket(ip, time.Minute, 5, 5, 1, time.Second))
+	if n := client.Exists(ctx, windowKey, bucketKey).Val(); n != 2 {
+		t.Errorf("Both keys should be written under the prefix, found %d of 2", n)
+	}
+
+	// Cleanup
+	client.Del(ctx, windowKey, bucketKey)
+}
+
+/*
+Testing the sliding window counter mode of RedisStore
+The state is a hash of three fields however many requests were made,
+and CheckAll honours the mode as well
+*/
+func TestRedisSlidingWindowCounter(t *testing.T) {
+	client := setupRedisClient()
+	if client == nil {
+		t.Skip("Redis not available, skipping test")
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	var store *RedisStore = NewRedisStore(client)
+	store.WindowMode = WindowCounter
+	var ip string = "test-counter"
+	client.Del(ctx, "counter:{"+ip+"}", "bucket:{"+ip+"}")
+
+	for i := 0; i < 5; i++ {
+		if d := store.CheckSlidingWindow(ctx, ip, time.Minute, 5, 1); !d.Allowed {
+			t.Errorf("Request %d should be allowed", i+1)
+		}
+	}
+	d := store.CheckSlidingWindow(ctx, ip, time.Minute, 5, 1)
+	if d.Allowed || d.Remaining != 0 || d.RetryAfter <= 0 || d.Algorithm != AlgorithmSlidingWindowCounter {
+		t.Errorf("6th request should be denied by the counter with a retry time, got %+v", d)
+	}
+	if fields := client.HLen(ctx, "counter:{"+ip+"}").Val(); fields != 3 {
+		t.Errorf("Counter state should be 3 hash fields, got %d", fields)
+	}
+
+	decisions := store.CheckAll(ctx, windowAndBucket(ip, time.Minute, 5, 10, 1, time.Second))
+	window, bucket := decisions[0], decisions[1]
+	if window.Allowed || !bucket.Allowed || bucket.Remaining != 10 {
+		t.Errorf("CheckAll should be denied by the counter without taking a token, got window=%v bucket=%v remaining=%d", window.Allowed, bucket.Allowed, bucket.Remaining)
+	}
+
+	// Cleanup
+	client.Del(ctx, "counter:{"+ip+"}", "bucket:{"+ip+"}")
+}
+
+/*
+Testing sub-second limits in Redis match the in-memory store:
+5 per 500ms and a bucket refilling 1 token per 100ms
+*/
+func TestRedisSubSecondLimits(t *testing.T) {
+	client := setupRedisClient()
+	if client == nil {
+		t.Skip("Redis not available, skipping test")
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	var store *RedisStore = NewRedisStore(client)
+	var ip string = "test-subsecond"
+	client.Del(ctx, "bucket:{"+ip+"}", "sliding:{"+ip+"}")
+
+	for i := 0; i < 5; i++ {
+		store.AllowedSlidingWindow(ip, 500*time.Millisecond, 5, 1)
+	}
+	if allowed, _, _ := store.AllowedSlidingWindow(ip, 500*time.Millisecond, 5, 1); allowed {
+		t.Error("6th request within 500ms should be denied")
+	}
+
+	store.AllowedTokenBucket(ip, 2, 1, 100*time.Millisecond, 2)
+	allowed, quota, _ := store.AllowedTokenBucket(ip, 2, 1, 100*time.Millisecond, 1)
+	if allowed {
+		t.Error("Empty bucket should deny before the first 100ms refill")
+	}
+	if quota.RetryAfter <= 0 || quota.RetryAfter > 100*time.Millisecond {
+		t.Errorf("RetryAfter should be within the 100ms refill interval, got %v", quota.RetryAfter)
+	}
+
+	time.Sleep(550 * time.Millisecond)
+
+	if allowed, _, _ := store.AllowedSlidingWindow(ip, 500*time.Millisecond, 5, 1); !allowed {
+		t.Error("Request after the 500ms window should be allowed")
+	}
+	if allowed, _, _ := store.AllowedTokenBucket(ip, 2, 1, 100*time.Millisecond, 2); !allowed {
+		t.Error("Bucket should have refilled within 550ms")
+	}
+
+	// Cleanup
+	client.Del(ctx, "bucket:{"+ip+"}", "sliding:{"+ip+"}")
+}
+
+/*
+Testing a refill rate below a microsecond matches the in-memory store
+A bucket of 2 refilling 1 token per 500ns is full again a few milliseconds after it is
+emptied, in Redis as in memory, rather than never refilling
+*/
+func TestRedisSubMicrosecondRefill(t *testing.T) {
+	client := setupRedisClient()
+	if client == nil {
+		t.Skip("Redis not available, skipping test")
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	var ip string = "test-submicro"
+	client.Del(ctx, "bucket:{"+ip+"}")
+	stores := map[string]RateLimiterStore{"memory": NewMemoryStore(), "redis": NewRedisStore(client)}
+
+	for name, store := range stores {
+		if allowed, _, _ := store.AllowedTokenBucket(ip, 2, 1, 500*time.Nanosecond, 2); !allowed {
+			t.Errorf("%s: The first request should take the full bucket", name)
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	for name, store := range stores {
+		if allowed, _, _ := store.AllowedTokenBucket(ip, 2, 1, 500*time.Nanosecond, 2); !allowed {
+			t.Errorf("%s: The bucket should have refilled within 5ms", name)
+		}
+	}
+
+	// Cleanup
+	client.Del(ctx, "bucket:{"+ip+"}")
+}
+
+/*
+Testing GCRA in Redis: the state is a single value and the burst behaves like the
+in-memory GCRA, a burst of 3 earning back 1 token per 100ms
+*/
+func TestRedisGCRA(t *testing.T) {
+	client := setupRedisClient()
+	if client == nil {
+		t.Skip("Redis not available, skipping test")
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	var store *RedisStore = NewRedisStore(client)
+	var ip string = "test-gcra"
+	client.Del(ctx, "gcra:{"+ip+"}")
+
+	for i := 0; i < 3; i++ {
+		if d := store.CheckGCRA(ctx, ip, 3, 1, 100*time.Millisecond, 1); !d.Allowed || d.Remaining != 2-i {
+			t.Errorf("Request %d should be allowed with %d remaining, got %+v", i+1, 2-i, d)
+		}
+	}
+	d := store.CheckGCRA(ctx, ip, 3, 1, 100*time.Millisecond, 1)
+	if d.Allowed || d.RetryAfter <= 0 || d.RetryAfter > 100*time.Millisecond {
+		t.Errorf("4th request should be denied with a retry within 100ms, got %+v", d)
+	}
+	if keyType := client.Type(ctx, "gcra:{"+ip+"}").Val(); keyType != "string" {
+		t.Errorf("GCRA state should be a single string value, got %s", keyType)
+	}
+
+	time.Sleep(d.RetryAfter)
+	if d := store.CheckGCRA(ctx, ip, 3, 1, 100*time.Millisecond, 1); !d.Allowed {
+		t.Error("Request after RetryAfter should be allowed")
+	}
+
+	// Cleanup
+	client.Del(ctx, "gcra:{"+ip+"}")
+}
+
+/*
+Testing GCRA without refills in Redis
+Same as in memory: the burst of 2 passes, then every request is denied with no reset time
+*/
+func TestRedisGCRANoRefill(t *testing.T) {
+	client := setupRedisClient()
+	if client == nil {
+		t.Skip("Redis not available, skipping test")
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	var store *RedisStore = NewRedisStore(client)
+	var ip string = "test-gcra-no-refill"
+	client.Del(ctx, "gcra:{"+ip+"}")
+
+	allowed := 0
+	for i := 0; i < 100; i++ {
+		if store.CheckGCRA(ctx, ip, 2, 0, 0, 1).Allowed {
+			allowed++
+		}
+	}
+	if allowed != 2 {
+		t.Errorf("Only the burst of 2 should be allowed, got %d", allowed)
+	}
+	d := store.CheckGCRA(ctx, ip, 2, 0, 0, 1)
+	if d.Allowed || d.Remaining != 0 || !d.ResetAt.IsZero() {
+		t.Errorf("Bucket that never refills should deny with no reset time, got %+v", d)
+	}
+
+	// Cleanup
+	client.Del(ctx, "gcra:{"+ip+"}")
+}
+
+/*
+Testing CheckAll across two actors in Redis
+The IP's window has room but the API key's bucket of 1 is empty: the denied request
+must not take a slot from the IP's window
+*/
+func TestRedisCheckAllAcrossActors(t *testing.T) {
+	client := setupRedisClient()
+	if client == nil {
+		t.Skip("Redis not available, skipping test")
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	var store *RedisStore = NewRedisStore(client)
+	ipKey, apiKey := "ip:test-actors", "apikey:test-actors"
+	client.Del(ctx, "sliding:{"+ipKey+"}", "bucket:{"+apiKey+"}")
+
+	limits := []LimitCheck{
+		{Key: ipKey, Algorithm: AlgorithmSlidingWindow, Window: time.Minute, Limit: 5, Cost: 1},
+		{Key: apiKey, Algorithm: AlgorithmTokenBucket, Capacity: 1, RefillRate: time.Minute, Cost: 1},
+	}
+	if d := store.CheckAll(ctx, limits); !d[0].Allowed || !d[1].Allowed {
+		t.Fatalf("First request should pass both limits, got %+v", d)
+	}
+	d := store.CheckAll(ctx, limits)
+	if !d[0].Allowed || d[1].Allowed || d[1].Algorithm != AlgorithmTokenBucket {
+		t.Errorf("Second request should be denied by the API key bucket only, got %+v", d)
+	}
+	if slots := client.ZCard(ctx, "sliding:{"+ipKey+"}").Val(); slots != 1 {
+		t.Errorf("Denied request should not take a window slot, window holds %d want 1", slots)
+	}
+
+	// Cleanup
+	client.Del(ctx, "sliding:{"+ipKey+"}", "bucket:{"+apiKey+"}")
+}
+
+/*
+Testing CheckAll through a Cluster client, where each actor's limits run in their own
+script: the actor denied in the dry run keeps the other actor from being charged
+*/
+func TestRedisCheckAllCluster(t *testing.T) {
+	single := setupRedisClient()
+	if single == nil {
+		t.Skip("Redis not available, skipping test")
+	}
+	addr := single.Options().Addr
+	single.Close()
+
+	ctx := context.Background()
+	client := redis.NewClusterClient(&redis.ClusterOptions{Addrs: []string{addr}})
+	defer client.Close()
+	if err := client.Ping(ctx).Err(); err != nil {
+		t.Skip("Redis is not running in cluster mode, skipping test")
+	}
+
+	var store *RedisStore = NewRedisStore(client)
+	ipKey, apiKey := "ip:test-cluster", "apikey:test-cluster"
+	client.Del(ctx, "sliding:{"+ipKey+"}")
+	client.Del(ctx, "bucket:{"+apiKey+"}")
+
+	limits := []LimitCheck{
+		{Key: ipKey, Algorithm: AlgorithmSlidingWindow, Window: time.Minute, Limit: 5, Cost: 1},
+		{Key: apiKey, Algorithm: AlgorithmTokenBucket, Capacity: 1, RefillRate: time.Minute, Cost: 1},
+	}
+	if d := store.CheckAll(ctx, limits); !d[0].Allowed || !d[1].Allowed {
+		t.Fatalf("First request should pass both limits, got %+v", d)
+	}
+	if d := store.CheckAll(ctx, limits); !d[0].Allowed || d[1].Allowed {
+		t.Errorf("Second request should be denied by the API key bucket only, got %+v", d)
+	}
+	if slots := client.ZCard(ctx, "sliding:{"+ipKey+"}").Val(); slots != 1 {
+		t.Errorf("Denied request should not take a window slot, window holds %d want 1", slots)
+	}
+
+	// Cleanup
+	client.Del(ctx, "sliding:{"+ipKey+"}")
+	client.Del(ctx, "bucket:{"+apiKey+"}")
+}
+
+/*
+Testing the limits script is sent by its SHA1
+After the first request Redis holds the script, and when its script cache is flushed
+the next request loads it again instead of failing with NOSCRIPT
+*/
+func TestRedisScriptCache(t *testing.T) {
+	client := setupRedisClient()
+	if client == nil {
+		t.Skip("Redis not available, skipping test")
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	var store *RedisStore = NewRedisStore(client)
+	var ip string = "test-script-cache"
+	client.Del(ctx, "bucket:{"+ip+"}")
+
+	if allowed, _, err := store.AllowedTokenBucket(ip, 2, 1, time.Minute, 1); !allowed || err != nil {
+		t.Fatalf("First request should be allowed, got %v, %v", allowed, err)
+	}
+	if exists, err := client.ScriptExists(ctx, limitsScript.Hash()).Result(); err != nil || !exists[0] {
+		t.Errorf("Redis should hold the limits script after a request, got %v, %v", exists, err)
+	}
+
+	client.ScriptFlush(ctx)
+	if allowed, _, err := store.AllowedTokenBucket(ip, 2, 1, time.Minute, 1); !allowed || err != nil {
+		t.Errorf("Request after a script flush should be allowed, got %v, %v", allowed, err)
+	}
+
+	// Cleanup
+	client.Del(ctx, "bucket:{"+ip+"}")
 }
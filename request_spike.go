@@ -0,0 +1,91 @@
+package ankylogo
+
+import (
+	"math"
+	"time"
+)
+
+// RequestSpikeDetector flags actors sending far more requests than they used to:
+// the requests of the current interval against the actor's baseline, an exponentially
+// weighted moving average of its requests per interval. Actors are only flagged once
+// their baseline has warmed up, so a new actor's first burst is not a spike
+type RequestSpikeDetector struct {
+	// Interval is the period requests are counted over (0 = 1 minute)
+	Interval time.Duration
+	// History is roughly how many intervals the baseline averages over (0 = 30).
+	// An actor idle for twice as long starts over
+	History int
+	// WarmUp is the number of intervals since an actor's first request before it can be flagged (0 = 5)
+	WarmUp int
+	// Threshold is the ratio of current requests to the baseline that gives a full signal (0 = 10),
+	// the signal starts once the ratio is above 2
+	Threshold float64
+	// MinBaseline is the lowest baseline in requests per interval (0 = 10),
+	// so a handful of requests from a quiet actor is not a spike
+	MinBaseline float64
+
+	actors actorStates[spikeState]
+}
+
+type spikeState struct {
+	interval int64   // number of the current interval since the unix epoch
+	count    int     // requests in the current interval
+	average  float64 // moving average of requests per interval, before the current one
+	seen     int     // intervals averaged, 0 until the first one ends
+}
+
+func (d *RequestSpikeDetector) Name() string {
+	return "request_spike"
+}
+
+func (d *RequestSpikeDetector) Observe(actor string, event RateLimitEvent) float64 {
+	interval := d.Interval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	history := d.History
+	if history <= 0 {
+		history = 30
+	}
+	warmUp := d.WarmUp
+	if warmUp <= 0 {
+		warmUp = 5
+	}
+	threshold := d.Threshold
+	if threshold <= 0 {
+		threshold = 10
+	}
+	minBaseline := d.MinBaseline
+	if minBaseline <= 0 {
+		minBaseline = 10
+	}
+	// the weight of the latest interval in the average, as for a simple average over history
+	alpha := 2 / (float64(history) + 1)
+
+	now := eventTime(event)
+	n := now.UnixNano() / int64(interval)
+	return d.actors.update(actor, now, 2*time.Duration(history)*interval, func(s *spikeState) float64 {
+		if s.seen == 0 && s.count == 0 {
+			s.interval = n
+		}
+		if n > s.interval {
+			// the interval that ended, then one without requests for each interval skipped
+			s.average += alpha * (float64(s.count) - s.average)
+			idle := n - s.interval - 1
+			s.average *= math.Pow(1-alpha, float64(idle))
+			s.seen += 1 + int(idle)
+			s.interval = n
+			s.count = 0
+		}
+		// late events count towards the current interval
+		s.count++
+
+		if s.seen < warmUp {
+			return 0
+		}
+		// the average starts from 0, divide out what is left of that start
+		baseline := s.average / (1 - math.Pow(1-alpha, float64(s.seen)))
+		baseline = max(baseline, minBaseline)
+		return ramp(float64(s.count)/baseline, 2, threshold)
+	})
+}
@@ -4,23 +4,34 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"math"
 	"sync"
 	"time"
 
 	"github.com/twmb/franz-go/pkg/kgo"
 )
 
+// RiskScore is the risk of one actor: the latest signal of each detector,
+// combined into a score from 0.0 to 1.0
 type RiskScore struct {
-	score       int64
+	score       float64
+	signals     []float64 // by detector, in the order of RiskEngine.Detectors
+	fired       []Signal  // by detector, when each last fired
+	lastEvent   time.Time // timestamp of the latest event
+	correlated  bool      // enough detectors fired together, see CorrelationPolicy
 	lastUpdated time.Time
 	notified    bool
 	mu          sync.Mutex
 }
 
 type ThresholdNotifier interface {
-	Notify(ip string, score int64)
+	Notify(actor string, score int64)
 }
 
+// RiskEngine scores actors from the events the middleware publishes. Every event goes
+// through each detector, the score is the weighted average of their signals, from 0.0 to 1.0.
+// GetScore reports it in points (1.0 = 100) for Config.DenyScore, and so is the threshold.
+// Scores lose a point every decayRate without new signals
 type RiskEngine struct {
 	client      *kgo.Client
 	ipScores    sync.Map
@@ -28,8 +39,15 @@ type RiskEngine struct {
 	topic       string
 	decayRate   time.Duration
 	OnThreshold ThresholdNotifier
+	// Detectors score every event, nil = DefaultDetectors(nil). Set it before the first event
+	Detectors     []WeightedDetector
+	detectorsOnce sync.Once
+	// Correlation, when set, keeps scores below the threshold until enough detectors
+	// fire together (nil = any detector can raise the score alone)
+	Correlation *CorrelationPolicy
 }
 
+// NewRiskEngine returns an engine that notifies once an actor's score is above threshold points
 func NewRiskEngine(client *kgo.Client, threshold int64, topic string, decayRate time.Duration) *RiskEngine {
 	return &RiskEngine{
 		client:    client,
@@ -39,73 +57,169 @@ func NewRiskEngine(client *kgo.Client, threshold int64, topic string, decayRate
 	}
 }
 
+// NewRiskScore returns a risk score of score points (100 = 1.0) as of lastUpdated
 func NewRiskScore(score int64, lastUpdated time.Time) *RiskScore {
 	return &RiskScore{
-		score:       score,
+		score:       float64(score) / 100,
 		lastUpdated: lastUpdated,
 	}
 }
 
-// GetScore returns the current effective risk score for an IP,
+// Score returns the current risk of an actor from 0.0 to 1.0,
 // applying time-based decay without modifying stored state
-func (r *RiskEngine) GetScore(ip string) int64 {
-	val, ok := r.ipScores.Load(ip)
+func (r *RiskEngine) Score(actor string) float64 {
+	val, ok := r.ipScores.Load(actor)
 	if !ok {
 		return 0
 	}
 	riskScore := val.(*RiskScore)
 	riskScore.mu.Lock()
 	defer riskScore.mu.Unlock()
-	current := riskScore.score
-	if r.decayRate > 0 {
-		now := time.Now()
-		elapsed := now.Sub(riskScore.lastUpdated)
-		intervals := int64(elapsed / r.decayRate)
-		current -= intervals
+	return r.decayed(riskScore.score, time.Since(riskScore.lastUpdated))
+}
+
+// GetScore returns the current effective risk score for an actor in points, 1.0 = 100
+func (r *RiskEngine) GetScore(actor string) int64 {
+	return scorePoints(r.Score(actor))
+}
+
+// Cooldown returns how long until the actor's score decays below score points,
+// 0 if it already is or if scores don't decay
+func (r *RiskEngine) Cooldown(actor string, score int64) time.Duration {
+	val, ok := r.ipScores.Load(actor)
+	if !ok || r.decayRate <= 0 || score <= 0 {
+		return 0
+	}
+	riskScore := val.(*RiskScore)
+	riskScore.mu.Lock()
+	defer riskScore.mu.Unlock()
+	points := scorePoints(riskScore.score)
+	if points < score {
+		return 0
+	}
+	// one point decays every decayRate
+	intervals := points - score + 1
+	wait := time.Until(riskScore.lastUpdated.Add(time.Duration(intervals) * r.decayRate))
+	if wait < 0 {
+		return 0
 	}
-	if current < 0 {
-		current = 0
+	return wait
+}
+
+// intervals returns the number of whole decay intervals in elapsed
+func (r *RiskEngine) intervals(elapsed time.Duration) int64 {
+	if r.decayRate <= 0 || elapsed <= 0 {
+		return 0
 	}
-	return current
+	return int64(elapsed / r.decayRate)
+}
+
+// decayed returns what is left of score after elapsed, one point less every decayRate, floored at 0
+func (r *RiskEngine) decayed(score float64, elapsed time.Duration) float64 {
+	return max(score-float64(r.intervals(elapsed))/100, 0)
+}
+
+// scorePoints converts a score from 0.0 to 1.0 to whole points, 1.0 = 100
+func scorePoints(score float64) int64 {
+	return int64(math.Round(score * 100))
 }
 
-// This function takes a the failed events for a specific ip and increments its risk score
-// for each failed attempt, if no failed attempts happen over a period of time, an interval system
-// is in place, so for example if interval was 30 minutes then if no failed api calls happen within 2 hours
-// the specific ip's risk score gets deducted by 4 points since there are 120 minutes in 2 hours and
-// 120 / 30 =  4
+// detectors returns the detectors in use
+func (r *RiskEngine) detectors() []WeightedDetector {
+	r.detectorsOnce.Do(func() {
+		if r.Detectors == nil {
+			r.Detectors = DefaultDetectors(nil)
+		}
+	})
+	return r.Detectors
+}
+
+// processEvent runs an event through every detector and updates the actor's score.
+// The stored signals decay with the score and each is replaced by the detector's new one when that
+// is stronger, so an actor has to stay calm for the score to come down. With a Correlation
+// policy the score is capped while too few detectors fired recently. It returns the
+// score in points and whether it just crossed the threshold
 func (r *RiskEngine) processEvent(event RateLimitEvent) (int64, bool) {
-	// bump the score for the ip for each denied event
-	newScore := &RiskScore{lastUpdated: time.Now()}
-	score, _ := r.ipScores.LoadOrStore(event.IP, newScore)
+	actor := eventActor(event)
+	detectors := r.detectors()
+	signals := make([]float64, len(detectors))
+	for i, d := range detectors {
+		signals[i] = min(max(d.Detector.Observe(actor, event), 0), 1)
+	}
+
+	score, ok := r.ipScores.Load(actor)
+	if !ok {
+		score, _ = r.ipScores.LoadOrStore(actor, &RiskScore{lastUpdated: time.Now()})
+	}
 	riskScore := score.(*RiskScore)
 	riskScore.mu.Lock()
+	defer riskScore.mu.Unlock()
+
 	now := time.Now()
+	elapsed := now.Sub(riskScore.lastUpdated)
+	if riskScore.signals == nil {
+		riskScore.signals = make([]float64, len(detectors))
+		riskScore.fired = make([]Signal, len(detectors))
+	}
+	var before, total float64
+	for i, d := range detectors {
+		before += d.Weight * riskScore.signals[i]
+		total += d.Weight
+	}
+	// the signals fade together, so their weighted average loses a point every decayRate
+	fade := 1.0
+	if before > 0 {
+		fade = r.decayed(before/total, elapsed) / (before / total)
+	}
+	var weighted float64
+	for i, d := range detectors {
+		riskScore.signals[i] = max(riskScore.signals[i]*fade, signals[i])
+		weighted += d.Weight * riskScore.signals[i]
+	}
+	// a score set through NewRiskScore decays like the signals
+	riskScore.score = r.decayed(riskScore.score, elapsed)
+	if total > 0 {
+		riskScore.score = max(riskScore.score, weighted/total)
+	}
+	// keep the part of an interval that has not decayed yet
 	if r.decayRate > 0 {
-		elapsed := now.Sub(riskScore.lastUpdated)
-		intervals := int64(elapsed / r.decayRate)
-		riskScore.score -= intervals
+		riskScore.lastUpdated = riskScore.lastUpdated.Add(time.Duration(r.intervals(elapsed)) * r.decayRate)
+	} else {
+		riskScore.lastUpdated = now
 	}
-	if riskScore.score < 0 {
-		riskScore.score = 0
+
+	policy := r.correlation()
+	at := eventTime(event)
+	riskScore.lastEvent = later(riskScore.lastEvent, at)
+	fired := policy.recordSignals(riskScore.fired, detectors, signals, at)
+	riskScore.correlated = r.Correlation == nil || fired >= policy.MinSignals
+	if !riskScore.correlated {
+		riskScore.score = min(riskScore.score, policy.Ceiling)
 	}
+	currentScore := scorePoints(riskScore.score)
+
 	// re-arm notification if score decayed back to or below threshold
-	if riskScore.score <= r.threshold {
+	if currentScore <= r.threshold {
 		riskScore.notified = false
 	}
-	riskScore.score += 1
-	riskScore.lastUpdated = now
-	currentScore := riskScore.score
 	// only signal notification on the first crossing
 	shouldNotify := false
 	if currentScore > r.threshold && !riskScore.notified {
 		riskScore.notified = true
 		shouldNotify = true
 	}
-	riskScore.mu.Unlock()
 	return currentScore, shouldNotify
 }
 
+// eventActor returns the identity an event should be scored under,
+// falling back to the IP for events published before Actor existed
+func eventActor(event RateLimitEvent) string {
+	if event.Actor != "" {
+		return event.Actor
+	}
+	return event.IP
+}
+
 func (r *RiskEngine) EventReader(ctx context.Context) {
 	for {
 		//poll fetches, this blocks until records do arrive
@@ -133,7 +247,7 @@ func (r *RiskEngine) EventReader(ctx context.Context) {
 			currentScore, shouldNotify := r.processEvent(event)
 
 			if shouldNotify && r.OnThreshold != nil {
-				r.OnThreshold.Notify(event.IP, currentScore)
+				r.OnThreshold.Notify(eventActor(event), currentScore)
 			}
 		})
 
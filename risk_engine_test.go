@@ -5,211 +5,227 @@ import (
 	"time"
 )
 
+// helper returning a response the handler answered, with a status code
+func responseEvent(actor string, status int) RateLimitEvent {
+	return RateLimitEvent{IP: actor, Endpoint: "POST /login", Action: "ALLOWED", StatusCode: status, UserAgent: "curl/8.0", Timestamp: time.Now().UnixNano()}
+}
+
 /*
-Test that the first denied event for an IP sets the score to 1
-A brand new IP with no history should start at exactly 1
+Test that ordinary traffic does not raise the score
+20 successful requests from one IP, all allowed, should leave the score at 0
 */
-func TestRiskScoreFirstEvent(t *testing.T) {
+func TestRiskScoreOrdinaryTraffic(t *testing.T) {
 	engine := &RiskEngine{
-		threshold: 5,
+		threshold: 30,
 		decayRate: 30 * time.Minute,
 	}
 
-	event := RateLimitEvent{
-		IP:        "192.168.1.1",
-		Endpoint:  "GET /ping",
-		Action:    "DENIED_WINDOW",
-		Timestamp: time.Now().UnixNano(),
+	var score int64
+	for i := 0; i < 20; i++ {
+		score, _ = engine.processEvent(responseEvent("192.168.1.1", 200))
 	}
+	if score != 0 {
+		t.Errorf("Successful requests should not raise the score, got %d", score)
+	}
+}
 
-	score, _ := engine.processEvent(event)
-	if score != 1 {
-		t.Errorf("First event should set score to 1, got %d", score)
+/*
+Test that rate limiter denials alone do not count as failed authentication
+A denial is answered with 429 or 403 by the middleware, not by the handler
+*/
+func TestRiskScoreDenialsAreNotFailedAuth(t *testing.T) {
+	engine := &RiskEngine{
+		threshold: 30,
+		decayRate: 30 * time.Minute,
+	}
+
+	event := RateLimitEvent{IP: "10.0.0.1", Endpoint: "POST /login", Action: "DENIED_RISK", StatusCode: 403, UserAgent: "curl/8.0", Timestamp: time.Now().UnixNano()}
+	var score int64
+	for i := 0; i < 10; i++ {
+		score, _ = engine.processEvent(event)
+	}
+	if score != 0 {
+		t.Errorf("Risk denials should not feed the failed auth signal, got %d", score)
 	}
 }
 
 /*
-Test that multiple rapid events from the same IP accumulate correctly
-5 events with no time for decay should produce a score of exactly 5
+Test that failed authentications raise the score by the weight of their detector
+10 responses of 401 give a full failed auth signal, worth 0.35 of the 0.75 the default detectors weigh without a locator
 */
-func TestRiskScoreMultipleEvents(t *testing.T) {
+func TestRiskScoreFailedAuth(t *testing.T) {
 	engine := &RiskEngine{
-		threshold: 10,
+		threshold: 50,
 		decayRate: 30 * time.Minute,
 	}
 
-	event := RateLimitEvent{
-		IP:        "10.0.0.1",
-		Endpoint:  "POST /login",
-		Action:    "DENIED_BUCKET",
-		Timestamp: time.Now().UnixNano(),
+	var score int64
+	for i := 0; i < 10; i++ {
+		score, _ = engine.processEvent(responseEvent("10.0.0.2", 401))
+	}
+	if score != 47 {
+		t.Errorf("A full failed auth signal should score 47 points, got %d", score)
 	}
+	if s := engine.Score("10.0.0.2"); s < 0.466 || s > 0.468 {
+		t.Errorf("Score should be 0.4667, got %f", s)
+	}
+}
 
-	var lastScore int64
-	for i := 0; i < 5; i++ {
-		lastScore, _ = engine.processEvent(event)
+/*
+Test that the score is the weighted average of the detector signals
+Two detectors weighing 3 and 1, only the first one fires: the score is 0.75
+*/
+func TestRiskScoreWeightedDetectors(t *testing.T) {
+	engine := &RiskEngine{
+		threshold: 100,
+		decayRate: 30 * time.Minute,
+		Detectors: []WeightedDetector{
+			{Detector: stubDetector{name: "on", signal: 1}, Weight: 3},
+			{Detector: stubDetector{name: "off", signal: 0}, Weight: 1},
+		},
 	}
 
-	if lastScore != 5 {
-		t.Errorf("After 5 rapid events score should be 5, got %d", lastScore)
+	score, _ := engine.processEvent(responseEvent("10.0.0.3", 200))
+	if score != 75 {
+		t.Errorf("Score should be 75 points, got %d", score)
 	}
 }
 
+// stubDetector returns the same signal for every event
+type stubDetector struct {
+	name   string
+	signal float64
+}
+
+func (d stubDetector) Name() string                                       { return d.name }
+func (d stubDetector) Observe(actor string, event RateLimitEvent) float64 { return d.signal }
+
 /*
 Test that different IPs have completely isolated scores
-Events from IP A should not affect IP B's score
+Failed logins from IP A should not affect IP B's score
 */
 func TestRiskScoreIsolatedIPs(t *testing.T) {
 	engine := &RiskEngine{
-		threshold: 10,
+		threshold: 50,
 		decayRate: 30 * time.Minute,
 	}
 
-	eventA := RateLimitEvent{IP: "1.1.1.1", Endpoint: "GET /ping", Action: "DENIED_WINDOW", Timestamp: time.Now().UnixNano()}
-	eventB := RateLimitEvent{IP: "2.2.2.2", Endpoint: "GET /ping", Action: "DENIED_WINDOW", Timestamp: time.Now().UnixNano()}
-
-	// 3 events for IP A
-	for i := 0; i < 3; i++ {
-		engine.processEvent(eventA)
+	for i := 0; i < 10; i++ {
+		engine.processEvent(responseEvent("1.1.1.1", 401))
 	}
-
-	// 1 event for IP B — should be 1, not 4
-	scoreB, _ := engine.processEvent(eventB)
-	if scoreB != 1 {
-		t.Errorf("IP B should have score 1 (isolated from A), got %d", scoreB)
+	scoreB, _ := engine.processEvent(responseEvent("2.2.2.2", 200))
+	if scoreB != 0 {
+		t.Errorf("IP B should have score 0 (isolated from A), got %d", scoreB)
+	}
+	if scoreA := engine.GetScore("1.1.1.1"); scoreA != 47 {
+		t.Errorf("IP A should keep its score of 47, got %d", scoreA)
 	}
+}
 
-	// IP A should now be 4 (3 previous + 1 new)
-	scoreA, _ := engine.processEvent(eventA)
-	if scoreA != 4 {
-		t.Errorf("IP A should have score 4 after 4th event, got %d", scoreA)
+// helper returning an engine scoring points for every POST /login event and none for the rest
+func loginEngine(points float64, decayRate time.Duration) *RiskEngine {
+	return &RiskEngine{
+		threshold: 10,
+		decayRate: decayRate,
+		Detectors: []WeightedDetector{
+			{Detector: endpointDetector("POST /login"), Weight: points},
+			{Detector: stubDetector{name: "off", signal: 0}, Weight: 100 - points},
+		},
 	}
 }
 
 /*
 Test that scores decay based on elapsed time
-With a decay rate of 100ms, after 350ms a score of 5 should decay by 3
-Then +1 for the new event = 3
+A score of 5 points loses one point every 100ms, ~3 intervals later it should be 5-3=2
 */
 func TestRiskScoreDecay(t *testing.T) {
-	engine := &RiskEngine{
-		threshold: 10,
-		decayRate: 100 * time.Millisecond,
-	}
+	engine := loginEngine(5, 100*time.Millisecond)
 
-	event := RateLimitEvent{IP: "10.0.0.5", Endpoint: "GET /ping", Action: "DENIED_WINDOW", Timestamp: time.Now().UnixNano()}
-
-	// Build up score to 5
-	for i := 0; i < 5; i++ {
-		engine.processEvent(event)
+	score, _ := engine.processEvent(responseEvent("10.0.0.5", 200))
+	if score != 5 {
+		t.Fatalf("A login should score 5 points, got %d", score)
 	}
 
 	// Wait for ~3 decay intervals
 	time.Sleep(350 * time.Millisecond)
 
-	// Score was 5, decay 3, +1 = 3
-	score, _ := engine.processEvent(event)
-	if score != 3 {
-		t.Errorf("After 3 decay intervals, score should be 5-3+1=3, got %d", score)
+	ping := responseEvent("10.0.0.5", 200)
+	ping.Endpoint = "GET /ping"
+	score, _ = engine.processEvent(ping)
+	if score != 2 {
+		t.Errorf("After 3 decay intervals, score should be 5-3=2, got %d", score)
 	}
 }
 
 /*
 Test that score decay floors at 0 and never goes negative
-With a score of 2 and enough time for 10 decay intervals,
-the score should floor at 0 then +1 for the new event = 1
+With a score of 2 and enough time for 6 decay intervals, the score should floor at 0
 */
 func TestRiskScoreDecayFloor(t *testing.T) {
-	engine := &RiskEngine{
-		threshold: 10,
-		decayRate: 100 * time.Millisecond,
-	}
-
-	event := RateLimitEvent{IP: "172.16.0.1", Endpoint: "GET /search", Action: "DENIED_BUCKET", Timestamp: time.Now().UnixNano()}
+	engine := loginEngine(2, 100*time.Millisecond)
 
-	// Build up score to 2
-	engine.processEvent(event)
-	engine.processEvent(event)
+	engine.processEvent(responseEvent("172.16.0.1", 200))
 
 	// Wait long enough that decay far exceeds current score
 	time.Sleep(600 * time.Millisecond)
 
-	// Score was 2, decay 6, floors at 0, +1 = 1
-	score, _ := engine.processEvent(event)
-	if score != 1 {
-		t.Errorf("After excessive decay, score should floor at 0 then +1 = 1, got %d", score)
+	ping := responseEvent("172.16.0.1", 200)
+	ping.Endpoint = "GET /search"
+	score, _ := engine.processEvent(ping)
+	if score != 0 {
+		t.Errorf("After excessive decay, score should floor at 0, got %d", score)
+	}
+	if s := engine.Score("172.16.0.1"); s != 0 {
+		t.Errorf("Score should floor at 0.0, got %f", s)
 	}
 }
 
 /*
 Test threshold crossing detection
-With a threshold of 3, events 1-3 should be at or below threshold
-The 4th event should cross it
+Each failed login adds 4.67 points, with a threshold of 30 the 7th one crosses it
 */
 func TestRiskScoreThresholdCrossing(t *testing.T) {
 	engine := &RiskEngine{
-		threshold: 3,
+		threshold: 30,
 		decayRate: 30 * time.Minute,
 	}
 
-	event := RateLimitEvent{IP: "192.168.0.100", Endpoint: "POST /login", Action: "DENIED_WINDOW", Timestamp: time.Now().UnixNano()}
-
-	// First 3 events should not exceed threshold
-	for i := 0; i < 3; i++ {
-		score, _ := engine.processEvent(event)
+	for i := 0; i < 6; i++ {
+		score, _ := engine.processEvent(responseEvent("192.168.0.100", 401))
 		if score > engine.threshold {
-			t.Errorf("Event %d should not exceed threshold of 3, score is %d", i+1, score)
+			t.Errorf("Failure %d should not exceed threshold of 30, score is %d", i+1, score)
 		}
 	}
 
-	// 4th event should exceed threshold
-	score, _ := engine.processEvent(event)
+	score, _ := engine.processEvent(responseEvent("192.168.0.100", 401))
 	if score <= engine.threshold {
-		t.Errorf("4th event should exceed threshold of 3, score is %d", score)
+		t.Errorf("7th failure should exceed threshold of 30, score is %d", score)
 	}
 }
 
 /*
 Test GetScore returns the correct effective score without modifying state
-Build up a score of 3, then verify GetScore returns 3 without changing it
+Build up a score of 47, then verify GetScore returns 47 without changing it
 */
 func TestRiskScoreGetScore(t *testing.T) {
 	engine := &RiskEngine{
-		threshold: 10,
+		threshold: 50,
 		decayRate: 30 * time.Minute,
 	}
 
-	event := RateLimitEvent{IP: "10.10.10.10", Endpoint: "GET /ping", Action: "DENIED_WINDOW", Timestamp: time.Now().UnixNano()}
-
-	for i := 0; i < 3; i++ {
-		engine.processEvent(event)
+	for i := 0; i < 10; i++ {
+		engine.processEvent(responseEvent("10.10.10.10", 403))
 	}
 
-	// GetScore should return 3
 	score := engine.GetScore("10.10.10.10")
-	if score != 3 {
-		t.Errorf("GetScore should return 3, got %d", score)
+	if score != 47 {
+		t.Errorf("GetScore should return 47, got %d", score)
 	}
 
-	// Calling GetScore again should still return 3 (read-only, no side effects)
+	// Calling GetScore again should still return 47 (read-only, no side effects)
 	score2 := engine.GetScore("10.10.10.10")
-	if score2 != 3 {
-		t.Errorf("GetScore called twice should still return 3, got %d", score2)
-	}
-}
-
-/*
-Test GetScore returns 0 for an unknown IP
-*/
-func TestRiskScoreGetScoreUnknownIP(t *testing.T) {
-	engine := &RiskEngine{
-		threshold: 10,
-		decayRate: 30 * time.Minute,
-	}
-
-	score := engine.GetScore("99.99.99.99")
-	if score != 0 {
-		t.Errorf("GetScore for unknown IP should return 0, got %d", score)
+	if score2 != 47 {
+		t.Errorf("GetScore called twice should still return 47, got %d", score2)
 	}
 }
 
@@ -219,17 +235,9 @@ Build up score to 5, wait for decay, verify GetScore returns decayed value
 Then verify processEvent still decays from original stored values
 */
 func TestRiskScoreGetScoreWithDecay(t *testing.T) {
-	engine := &RiskEngine{
-		threshold: 10,
-		decayRate: 100 * time.Millisecond,
-	}
-
-	event := RateLimitEvent{IP: "10.0.0.99", Endpoint: "GET /ping", Action: "DENIED_WINDOW", Timestamp: time.Now().UnixNano()}
+	engine := loginEngine(5, 100*time.Millisecond)
 
-	// Build up score to 5
-	for i := 0; i < 5; i++ {
-		engine.processEvent(event)
-	}
+	engine.processEvent(responseEvent("10.0.0.99", 200))
 
 	// Wait for ~3 decay intervals
 	time.Sleep(350 * time.Millisecond)
@@ -239,6 +247,28 @@ func TestRiskScoreGetScoreWithDecay(t *testing.T) {
 	if score != 2 {
 		t.Errorf("GetScore after decay should return 2, got %d", score)
 	}
+
+	ping := responseEvent("10.0.0.99", 200)
+	ping.Endpoint = "GET /ping"
+	score, _ = engine.processEvent(ping)
+	if score != 2 {
+		t.Errorf("processEvent should decay the stored score once, to 2, got %d", score)
+	}
+}
+
+/*
+Test GetScore returns 0 for an unknown IP
+*/
+func TestRiskScoreGetScoreUnknownIP(t *testing.T) {
+	engine := &RiskEngine{
+		threshold: 10,
+		decayRate: 30 * time.Minute,
+	}
+
+	score := engine.GetScore("99.99.99.99")
+	if score != 0 {
+		t.Errorf("GetScore for unknown IP should return 0, got %d", score)
+	}
 }
 
 /*
@@ -260,25 +290,25 @@ func (m *mockNotifier) Notify(ip string, score int64) {
 func TestRiskScoreThresholdNotifier(t *testing.T) {
 	notifier := &mockNotifier{}
 	engine := &RiskEngine{
-		threshold:   3,
+		threshold:   30,
 		decayRate:   30 * time.Minute,
 		OnThreshold: notifier,
 	}
 
-	event := RateLimitEvent{IP: "192.168.1.50", Endpoint: "POST /login", Action: "DENIED_WINDOW", Timestamp: time.Now().UnixNano()}
+	event := responseEvent("192.168.1.50", 401)
 
-	// First 3 events — shouldNotify must be false (scores 1, 2, 3 which are <= threshold)
-	for i := 0; i < 3; i++ {
+	// First 6 failures — shouldNotify must be false (28 points, <= threshold)
+	for i := 0; i < 6; i++ {
 		_, shouldNotify := engine.processEvent(event)
 		if shouldNotify {
-			t.Errorf("Event %d should not trigger notification (score <= threshold)", i+1)
+			t.Errorf("Failure %d should not trigger notification (score <= threshold)", i+1)
 		}
 	}
 
-	// 4th event pushes score to 4, which exceeds threshold of 3 — first crossing
+	// 7th failure pushes the score to 32.7, rounded to 33, which exceeds threshold of 30 — first crossing
 	currentScore, shouldNotify := engine.processEvent(event)
 	if !shouldNotify {
-		t.Errorf("4th event should trigger notification (first threshold crossing)")
+		t.Errorf("7th failure should trigger notification (first threshold crossing)")
 	}
 	if shouldNotify {
 		engine.OnThreshold.Notify(event.IP, currentScore)
@@ -290,15 +320,15 @@ func TestRiskScoreThresholdNotifier(t *testing.T) {
 	if notifier.calledIP != "192.168.1.50" {
 		t.Errorf("Notifier should have been called with IP 192.168.1.50, got %s", notifier.calledIP)
 	}
-	if notifier.calledScore != 4 {
-		t.Errorf("Notifier should have been called with score 4, got %d", notifier.calledScore)
+	if notifier.calledScore != 33 {
+		t.Errorf("Notifier should have been called with score 33, got %d", notifier.calledScore)
 	}
 
-	// 5th and 6th events — shouldNotify must be false (already notified, no re-arm)
-	for i := 5; i <= 6; i++ {
+	// 8th and 9th failures — shouldNotify must be false (already notified, no re-arm)
+	for i := 8; i <= 9; i++ {
 		_, shouldNotify := engine.processEvent(event)
 		if shouldNotify {
-			t.Errorf("Event %d should NOT trigger notification (already notified)", i)
+			t.Errorf("Failure %d should NOT trigger notification (already notified)", i)
 		}
 	}
 
@@ -308,30 +338,161 @@ func TestRiskScoreThresholdNotifier(t *testing.T) {
 }
 
 /*
-Test that decayRate of 0 does not panic and scores accumulate without decay
-With no decay configured, score should just keep going up
+Test that decayRate of 0 does not panic and scores do not decay
 */
 func TestRiskScoreZeroDecayRate(t *testing.T) {
 	engine := &RiskEngine{
-		threshold: 10,
+		threshold: 50,
 		decayRate: 0,
 	}
 
-	event := RateLimitEvent{IP: "10.0.0.50", Endpoint: "GET /ping", Action: "DENIED_WINDOW", Timestamp: time.Now().UnixNano()}
-
-	// 5 events should accumulate to 5 with no decay
 	var lastScore int64
-	for i := 0; i < 5; i++ {
-		lastScore, _ = engine.processEvent(event)
+	for i := 0; i < 10; i++ {
+		lastScore, _ = engine.processEvent(responseEvent("10.0.0.50", 401))
 	}
-
-	if lastScore != 5 {
-		t.Errorf("With zero decayRate, 5 events should give score 5, got %d", lastScore)
+	if lastScore != 47 {
+		t.Errorf("With zero decayRate, 10 failures should give score 47, got %d", lastScore)
 	}
 
-	// GetScore should also return 5 without panicking
+	// GetScore should also return 47 without panicking
 	score := engine.GetScore("10.0.0.50")
-	if score != 5 {
-		t.Errorf("GetScore with zero decayRate should return 5, got %d", score)
+	if score != 47 {
+		t.Errorf("GetScore with zero decayRate should return 47, got %d", score)
+	}
+	if cooldown := engine.Cooldown("10.0.0.50", 10); cooldown != 0 {
+		t.Errorf("Scores that never decay have no cooldown, got %v", cooldown)
+	}
+}
+
+/*
+Test that events carrying an Actor are scored under the actor, not the IP
+Two API keys behind one NAT IP should get isolated scores
+*/
+func TestRiskScoreKeyedByActor(t *testing.T) {
+	engine := &RiskEngine{
+		threshold: 50,
+		decayRate: 30 * time.Minute,
+	}
+
+	eventA := responseEvent("203.0.113.1", 401)
+	eventA.Actor = "header:aaaa"
+	eventB := responseEvent("203.0.113.1", 200)
+	eventB.Actor = "header:bbbb"
+
+	for i := 0; i < 10; i++ {
+		engine.processEvent(eventA)
+	}
+	engine.processEvent(eventB)
+
+	if score := engine.GetScore("header:aaaa"); score != 47 {
+		t.Errorf("Actor A should have score 47, got %d", score)
+	}
+	if score := engine.GetScore("header:bbbb"); score != 0 {
+		t.Errorf("Actor B should have score 0, got %d", score)
+	}
+	if score := engine.GetScore("203.0.113.1"); score != 0 {
+		t.Errorf("The shared IP should not accumulate a score when events carry an actor, got %d", score)
+	}
+}
+
+/*
+Test Cooldown reports how long until a score decays below a level
+A score of 47 losing a point every minute needs 31 minutes to get below 17
+*/
+func TestRiskScoreCooldown(t *testing.T) {
+	engine := &RiskEngine{
+		threshold: 50,
+		decayRate: time.Minute,
+	}
+
+	for i := 0; i < 10; i++ {
+		engine.processEvent(responseEvent("10.0.0.77", 401))
+	}
+
+	cooldown := engine.Cooldown("10.0.0.77", 17)
+	if cooldown < 31*time.Minute-time.Second || cooldown > 31*time.Minute {
+		t.Errorf("Cooldown below 17 should be about 31m, got %v", cooldown)
+	}
+	if cooldown := engine.Cooldown("10.0.0.77", 48); cooldown != 0 {
+		t.Errorf("Cooldown should be 0 when the score is already below the level, got %v", cooldown)
+	}
+	if cooldown := engine.Cooldown("99.99.99.99", 17); cooldown != 0 {
+		t.Errorf("Cooldown for an unknown actor should be 0, got %v", cooldown)
+	}
+}
+
+// endpointDetector fires for events of the endpoint it is named after
+type endpointDetector string
+
+func (d endpointDetector) Name() string { return string(d) }
+func (d endpointDetector) Observe(actor string, event RateLimitEvent) float64 {
+	if event.Endpoint == string(d) {
+		return 1
+	}
+	return 0
+}
+
+/*
+Test the correlation gate
+With a threshold of 30 and a policy of 2 detectors, one detector firing holds the score
+at 29 points, uncorrelated and without a notification. A second one within the window lets it through,
+and both are recorded for Explain
+*/
+func TestRiskScoreCorrelationGate(t *testing.T) {
+	engine := &RiskEngine{
+		threshold:   30,
+		decayRate:   30 * time.Minute,
+		Correlation: &CorrelationPolicy{},
+		Detectors: []WeightedDetector{
+			{Detector: endpointDetector("GET /a"), Weight: 1},
+			{Detector: endpointDetector("GET /b"), Weight: 1},
+		},
+	}
+
+	now := time.Now()
+	score, notify := engine.processEvent(RateLimitEvent{IP: "10.0.0.9", Endpoint: "GET /a", Timestamp: now.UnixNano()})
+	if score != 29 || notify || engine.Correlated("10.0.0.9") {
+		t.Errorf("A single detector should be held below the threshold, got %d (notify %v)", score, notify)
+	}
+	if signals := engine.Explain("10.0.0.9"); len(signals) != 1 || signals[0].Detector != "GET /a" {
+		t.Errorf("Expected GET /a to be recorded, got %+v", signals)
+	}
+
+	score, notify = engine.processEvent(RateLimitEvent{IP: "10.0.0.9", Endpoint: "GET /b", Timestamp: now.Add(time.Minute).UnixNano()})
+	if score != 100 || !notify || !engine.Correlated("10.0.0.9") {
+		t.Errorf("Two detectors within the window should reach 100 points and notify, got %d (notify %v)", score, notify)
+	}
+	signals := engine.Explain("10.0.0.9")
+	if len(signals) != 2 || signals[0].Detector != "GET /a" || signals[1].Detector != "GET /b" || signals[1].Strength != 1 {
+		t.Errorf("Expected both detectors to be recorded, got %+v", signals)
+	}
+}
+
+/*
+Test that detectors firing further apart than the correlation window are not correlated
+GET /a then GET /b 11 minutes later stays held below the threshold and only GET /b is explained
+*/
+func TestRiskScoreCorrelationWindow(t *testing.T) {
+	engine := &RiskEngine{
+		threshold:   30,
+		decayRate:   30 * time.Minute,
+		Correlation: &CorrelationPolicy{Window: 10 * time.Minute},
+		Detectors: []WeightedDetector{
+			{Detector: endpointDetector("GET /a"), Weight: 1},
+			{Detector: endpointDetector("GET /b"), Weight: 1},
+		},
+	}
+
+	now := time.Now()
+	engine.processEvent(RateLimitEvent{IP: "10.0.0.10", Endpoint: "GET /a", Timestamp: now.UnixNano()})
+	score, notify := engine.processEvent(RateLimitEvent{IP: "10.0.0.10", Endpoint: "GET /b", Timestamp: now.Add(11 * time.Minute).UnixNano()})
+	if score != 29 || notify {
+		t.Errorf("Detectors 11 minutes apart should not be correlated, got %d (notify %v)", score, notify)
+	}
+	if signals := engine.Explain("10.0.0.10"); len(signals) != 1 || signals[0].Detector != "GET /b" {
+		t.Errorf("Only GET /b should be within the window, got %+v", signals)
+	}
+	if signals := engine.Explain("10.0.0.11"); signals != nil {
+		t.Errorf("An unknown actor has nothing to explain, got %+v", signals)
 	}
 }
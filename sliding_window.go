@@ -1,7 +1,6 @@
 package ankylogo
 
 import (
-	"container/list"
 	"sync"
 	"time"
 )
@@ -15,43 +14,162 @@ type RateLimiter interface {
 var _ RateLimiter = (*SlidingWindowLimiter)(nil)
 
 type SlidingWindowLimiter struct {
-	window int64
+	window time.Duration
 	limit  int
-	logs   *list.List // deque // push_back, push_front -> in O(1)
+	logs   []windowEntry // accepted requests oldest first, from head on
+	head   int           // entries before head fell out of the window
+	used   int           // sum of the costs currently in logs
 	mutex  sync.Mutex
 }
 
-func NewSlidingWindowLimiter(window int64, limit int) *SlidingWindowLimiter {
+// windowEntry is one accepted request in the log and how many slots it took
+type windowEntry struct {
+	at   time.Time
+	cost int
+}
+
+func NewSlidingWindowLimiter(window time.Duration, limit int) *SlidingWindowLimiter {
 	return &SlidingWindowLimiter{
 		window: window,
 		limit:  limit,
-		logs:   list.New(),
 	}
 }
 
 func (sw *SlidingWindowLimiter) Allow() bool {
+	allowed, _ := sw.AllowN(1)
+	return allowed
+}
+
+// AllowN accepts a request that takes cost slots of the window
+// and returns the state of the window afterwards
+func (sw *SlidingWindowLimiter) AllowN(cost int) (bool, Quota) {
 	sw.mutex.Lock()
 	defer sw.mutex.Unlock()
 
 	now := time.Now()
-	delta := now.Unix() - sw.window
-	edgeTime := time.Unix(delta, 0)
+	sw.evict(now)
 
-	// Remove outdated logs
-	for sw.logs.Len() > 0 {
-		front := sw.logs.Front()
-		if front.Value.(time.Time).Before(edgeTime) {
-			sw.logs.Remove(front)
-		} else {
-			break
+	// Check if we can accept the request
+	if sw.used+cost <= sw.limit {
+		sw.push(windowEntry{at: now, cost: cost})
+		return true, sw.quota(now, 0)
+	}
+
+	return false, sw.quota(now, cost)
+}
+
+// configure applies the parameters of the current request,
+// the requests already logged count against the new limit
+func (sw *SlidingWindowLimiter) configure(window time.Duration, limit int) {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+
+	sw.window = window
+	sw.limit = limit
+}
+
+// peek reports whether cost slots are free and the state of the window, without taking them
+func (sw *SlidingWindowLimiter) peek(cost int) (bool, Quota) {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+
+	now := time.Now()
+	sw.evict(now)
+	if sw.used+cost <= sw.limit {
+		return true, sw.quota(now, 0)
+	}
+	return false, sw.quota(now, cost)
+}
+
+func (sw *SlidingWindowLimiter) take(cost int) (bool, Quota) {
+	return sw.AllowN(cost)
+}
+
+// refund removes the newest entry of cost slots, taken by a request that was denied elsewhere
+func (sw *SlidingWindowLimiter) refund(cost int) {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+
+	for i := len(sw.logs) - 1; i >= sw.head; i-- {
+		if sw.logs[i].cost == cost {
+			sw.logs = append(sw.logs[:i], sw.logs[i+1:]...)
+			sw.used -= cost
+			return
 		}
 	}
+}
 
-	// Check if we can accept the request
-	if sw.logs.Len() < sw.limit {
-		sw.logs.PushBack(now)
-		return true
+// Debit records cost slots without checking the limit, so the window can
+// be pushed over its limit by a penalty charged after the response
+func (sw *SlidingWindowLimiter) Debit(cost int) {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+
+	now := time.Now()
+	sw.evict(now)
+	sw.push(windowEntry{at: now, cost: cost})
+}
+
+// push appends an entry to the log, caller must hold sw.mutex.
+// The space of evicted entries is reused, so a busy key stops allocating once its log is big enough
+func (sw *SlidingWindowLimiter) push(entry windowEntry) {
+	if sw.head > 0 && len(sw.logs) == cap(sw.logs) {
+		n := copy(sw.logs, sw.logs[sw.head:])
+		sw.logs = sw.logs[:n]
+		sw.head = 0
+	}
+	sw.logs = append(sw.logs, entry)
+	sw.used += entry.cost
+}
+
+// evict drops log entries that fell out of the window, caller must hold sw.mutex
+func (sw *SlidingWindowLimiter) evict(now time.Time) {
+	edgeTime := now.Add(-sw.window)
+
+	// Remove outdated logs
+	for sw.head < len(sw.logs) && !sw.logs[sw.head].at.After(edgeTime) {
+		sw.used -= sw.logs[sw.head].cost
+		sw.head++
 	}
+	if sw.head == len(sw.logs) {
+		sw.logs = sw.logs[:0]
+		sw.head = 0
+	}
+}
+
+// expiresAt is when an entry falls out of the window
+func (sw *SlidingWindowLimiter) expiresAt(at time.Time) time.Time {
+	return at.Add(sw.window)
+}
+
+// recoveredAt is when the newest entry falls out of the window
+func (sw *SlidingWindowLimiter) recoveredAt() (time.Time, bool) {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
 
-	return false
+	if len(sw.logs) > sw.head {
+		return sw.expiresAt(sw.logs[len(sw.logs)-1].at), true
+	}
+	return time.Time{}, true
+}
+
+// quota describes the window for a response, caller must hold sw.mutex.
+// needed is the cost of a denied request, used to work out when it would fit
+func (sw *SlidingWindowLimiter) quota(now time.Time, needed int) Quota {
+	q := Quota{Limit: sw.limit, Remaining: max(sw.limit-sw.used, 0)}
+	if len(sw.logs) > sw.head {
+		q.ResetAt = sw.expiresAt(sw.logs[len(sw.logs)-1].at)
+	}
+	if needed > 0 && needed <= sw.limit {
+		// walk from the oldest entry until enough slots have been freed
+		used := sw.used
+		for _, entry := range sw.logs[sw.head:] {
+			used -= entry.cost
+			if used+needed <= sw.limit {
+				q.RetryAfter = max(sw.expiresAt(entry.at).Sub(now), 0)
+				break
+			}
+		}
+	}
+	return q
 }
@@ -0,0 +1,169 @@
+package ankylogo
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// The following block implements the sliding window counter algorithm.
+// Instead of logging every request it keeps two counters: the current fixed window and
+// the previous one. The previous window's count is weighted by how much of it still
+// overlaps the sliding window, e.g. 30% into the current window the estimate is
+// previous*0.7 + current. Memory per key is constant.
+
+var _ RateLimiter = (*SlidingWindowCounter)(nil)
+
+type SlidingWindowCounter struct {
+	window   time.Duration
+	limit    int
+	start    time.Time // start of the current fixed window
+	current  int       // cost accepted in the current fixed window
+	previous int       // cost accepted in the fixed window before it
+	mutex    sync.Mutex
+}
+
+// NewSlidingWindowCounter returns a counter over windows of window, at least 1ns
+func NewSlidingWindowCounter(window time.Duration, limit int) *SlidingWindowCounter {
+	return &SlidingWindowCounter{
+		window: max(window, 1),
+		limit:  limit,
+	}
+}
+
+func (sc *SlidingWindowCounter) Allow() bool {
+	allowed, _ := sc.AllowN(1)
+	return allowed
+}
+
+// AllowN accepts a request that takes cost slots of the window
+// and returns the state of the window afterwards
+func (sc *SlidingWindowCounter) AllowN(cost int) (bool, Quota) {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	now := time.Now()
+	sc.advance(now)
+
+	if sc.estimate(now)+float64(cost) <= float64(sc.limit) {
+		sc.current += cost
+		return true, sc.quota(now, 0)
+	}
+	return false, sc.quota(now, cost)
+}
+
+// configure applies the parameters of the current request. The counts are kept, a new
+// window length moves the current window onto the new grid rather than starting afresh
+func (sc *SlidingWindowCounter) configure(window time.Duration, limit int) {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	sc.limit = limit
+	window = max(window, 1)
+	if window == sc.window {
+		return
+	}
+	sc.window = window
+	if !sc.start.IsZero() {
+		now := time.Now()
+		sc.start = time.Unix(0, now.UnixNano()-now.UnixNano()%int64(window))
+	}
+}
+
+// peek reports whether cost slots are free and the state of the window, without taking them
+func (sc *SlidingWindowCounter) peek(cost int) (bool, Quota) {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	now := time.Now()
+	sc.advance(now)
+	if sc.estimate(now)+float64(cost) <= float64(sc.limit) {
+		return true, sc.quota(now, 0)
+	}
+	return false, sc.quota(now, cost)
+}
+
+func (sc *SlidingWindowCounter) take(cost int) (bool, Quota) {
+	return sc.AllowN(cost)
+}
+
+// refund takes cost slots back off the current window, for a request that was denied elsewhere
+func (sc *SlidingWindowCounter) refund(cost int) {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	sc.current = max(sc.current-cost, 0)
+}
+
+// Debit records cost slots without checking the limit, so the window can
+// be pushed over its limit by a penalty charged after the response
+func (sc *SlidingWindowCounter) Debit(cost int) {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	sc.advance(time.Now())
+	sc.current += cost
+}
+
+// advance moves to the fixed window containing now, caller must hold sc.mutex.
+// Windows are aligned to the unix epoch so every store agrees on the boundaries
+func (sc *SlidingWindowCounter) advance(now time.Time) {
+	start := time.Unix(0, now.UnixNano()-now.UnixNano()%int64(sc.window))
+	switch {
+	case start.Equal(sc.start):
+		return
+	case start.Equal(sc.start.Add(sc.window)):
+		sc.previous = sc.current
+	default:
+		// more than a whole window went by without requests
+		sc.previous = 0
+	}
+	sc.current = 0
+	sc.start = start
+}
+
+// estimate is the weighted count of the sliding window ending at now, caller must hold sc.mutex
+func (sc *SlidingWindowCounter) estimate(now time.Time) float64 {
+	weight := 1 - float64(now.Sub(sc.start))/float64(sc.window)
+	return float64(sc.previous)*weight + float64(sc.current)
+}
+
+// recoveredAt is when neither fixed window weighs in any more
+func (sc *SlidingWindowCounter) recoveredAt() (time.Time, bool) {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	return sc.quota(time.Now(), 0).ResetAt, true
+}
+
+// quota describes the window for a response, caller must hold sc.mutex.
+// needed is the cost of a denied request, used to work out when it would fit
+func (sc *SlidingWindowCounter) quota(now time.Time, needed int) Quota {
+	used := int(math.Ceil(sc.estimate(now)))
+	q := Quota{Limit: sc.limit, Remaining: max(sc.limit-used, 0)}
+
+	// the current window's count stops weighing in one window after it ends
+	if sc.current > 0 {
+		q.ResetAt = sc.start.Add(2 * sc.window)
+	} else if sc.previous > 0 {
+		q.ResetAt = sc.start.Add(sc.window)
+	}
+
+	if needed > 0 && needed <= sc.limit {
+		elapsed := float64(now.Sub(sc.start))
+		window := float64(sc.window)
+		var wait float64
+		if free := sc.limit - sc.current - needed; free >= 0 {
+			if sc.previous == 0 {
+				return q
+			}
+			// fits in this window once the previous window's weight has dropped enough
+			wait = window*(1-float64(free)/float64(sc.previous)) - elapsed
+		} else {
+			// only fits in the next window, once this window's count has faded enough
+			wait = window - elapsed + window*(1-float64(sc.limit-needed)/float64(sc.current))
+		}
+		q.RetryAfter = time.Duration(math.Ceil(max(wait, 0)))
+	}
+	return q
+}
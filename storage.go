@@ -1,10 +1,221 @@
 package ankylogo
 
 import (
+	"context"
 	"time"
 )
 
+// Algorithm names reported in Decision.Algorithm
+const (
+	AlgorithmSlidingWindow        = "sliding_window"
+	AlgorithmSlidingWindowCounter = "sliding_window_counter"
+	AlgorithmTokenBucket          = "token_bucket"
+	AlgorithmGCRA                 = "gcra"
+)
+
+// BucketAlgorithm selects how the burst limit of a Config or Dimension (Capacity,
+// TokensPerInterval, RefillRate) is enforced
+type BucketAlgorithm int
+
+const (
+	// BucketTokens is the token bucket, refilled with TokensPerInterval on every RefillRate. Default
+	BucketTokens BucketAlgorithm = iota
+	// BucketGCRA is the generic cell rate algorithm: the same burst of Capacity, earned back
+	// evenly over each RefillRate, stored as a single timestamp per key. Needs a store
+	// implementing GCRAStore, others fall back to the token bucket
+	BucketGCRA
+)
+
+// WindowMode selects how a store implements the sliding window
+type WindowMode int
+
+const (
+	// WindowLog records every accepted request, exact but O(n) memory per key
+	// where n is the number of requests in the window. Default
+	WindowLog WindowMode = iota
+	// WindowCounter keeps a counter for the current and the previous fixed window and
+	// interpolates between them. Constant memory per key, slightly approximate: it
+	// assumes the previous window's requests were evenly spread
+	WindowCounter
+)
+
+// algorithm is the Decision.Algorithm name of a window mode
+func (m WindowMode) algorithm() string {
+	if m == WindowCounter {
+		return AlgorithmSlidingWindowCounter
+	}
+	return AlgorithmSlidingWindow
+}
+
+// DecisionStore keeps the rate limit state for each key and is what the middleware talks to.
+// cost is the number of tokens (token bucket) or window slots (sliding window) a request consumes.
+//
+// The Check methods consume cost only if it fits and report the outcome as a Decision.
+// The Charge methods consume cost after a request has already been served (see
+// Config.ResponseCost). They always consume, so a token bucket can go negative
+// and the actor has to wait for the debt to refill before the next request.
+type DecisionStore interface {
+	CheckSlidingWindow(ctx context.Context, key string, window time.Duration, limit, cost int) Decision
+	CheckTokenBucket(ctx context.Context, key string, capacity, tokensPerInterval int, refillRate time.Duration, cost int) Decision
+	ChargeSlidingWindow(ctx context.Context, key string, window time.Duration, limit, cost int) error
+	ChargeTokenBucket(ctx context.Context, key string, capacity, tokensPerInterval int, refillRate time.Duration, cost int) error
+}
+
+// BatchStore is implemented by stores that can check every limit of a request at once and
+// charge them only if all of them allow it, so a request denied by one limit (e.g. the API key's
+// bucket) never uses up another (e.g. the IP's window). The middleware uses it when available,
+// other stores are checked one limit at a time.
+//
+// One decision is returned per limit, in order. Each reports whether its own limit had room;
+// the request was only charged if every decision is allowed.
+type BatchStore interface {
+	CheckAll(ctx context.Context, limits []LimitCheck) []Decision
+}
+
+// LimitCheck is one limit a request is checked against, see BatchStore
+type LimitCheck struct {
+	Key string
+	// Algorithm is AlgorithmSlidingWindow for the store's sliding window (in its WindowMode),
+	// AlgorithmTokenBucket or AlgorithmGCRA
+	Algorithm string
+	// sliding window
+	Window time.Duration
+	Limit  int
+	// token bucket or GCRA
+	Capacity          int
+	TokensPerInterval int
+	RefillRate        time.Duration
+	Cost              int
+}
+
+// limit is the Limit or Capacity, whichever the check's algorithm uses
+func (l LimitCheck) limit() int {
+	if l.isBucket() {
+		return l.Capacity
+	}
+	return l.Limit
+}
+
+func (l LimitCheck) isBucket() bool {
+	return l.Algorithm == AlgorithmTokenBucket || l.Algorithm == AlgorithmGCRA
+}
+
+// checkLimit checks a single limit with the DecisionStore or GCRAStore method for its algorithm.
+// GCRA falls back to the token bucket on stores without GCRA support
+func checkLimit(ctx context.Context, store DecisionStore, l LimitCheck) Decision {
+	switch l.Algorithm {
+	case AlgorithmGCRA:
+		if gcra, ok := store.(GCRAStore); ok {
+			return gcra.CheckGCRA(ctx, l.Key, l.Capacity, l.TokensPerInterval, l.RefillRate, l.Cost)
+		}
+		return store.CheckTokenBucket(ctx, l.Key, l.Capacity, l.TokensPerInterval, l.RefillRate, l.Cost)
+	case AlgorithmTokenBucket:
+		return store.CheckTokenBucket(ctx, l.Key, l.Capacity, l.TokensPerInterval, l.RefillRate, l.Cost)
+	default:
+		return store.CheckSlidingWindow(ctx, l.Key, l.Window, l.Limit, l.Cost)
+	}
+}
+
+// chargeLimit is checkLimit for the Charge methods
+func chargeLimit(ctx context.Context, store DecisionStore, l LimitCheck) error {
+	switch l.Algorithm {
+	case AlgorithmGCRA:
+		if gcra, ok := store.(GCRAStore); ok {
+			return gcra.ChargeGCRA(ctx, l.Key, l.Capacity, l.TokensPerInterval, l.RefillRate, l.Cost)
+		}
+		return store.ChargeTokenBucket(ctx, l.Key, l.Capacity, l.TokensPerInterval, l.RefillRate, l.Cost)
+	case AlgorithmTokenBucket:
+		return store.ChargeTokenBucket(ctx, l.Key, l.Capacity, l.TokensPerInterval, l.RefillRate, l.Cost)
+	default:
+		return store.ChargeSlidingWindow(ctx, l.Key, l.Window, l.Limit, l.Cost)
+	}
+}
+
+// checkEach is CheckAll for stores that are not a BatchStore: the limits are checked one after
+// another and checking stops at the first denial. Limits before it have already been charged
+func checkEach(ctx context.Context, store DecisionStore, limits []LimitCheck) []Decision {
+	decisions := make([]Decision, 0, len(limits))
+	for _, l := range limits {
+		d := checkLimit(ctx, store, l)
+		decisions = append(decisions, d)
+		if !d.Allowed && d.Err == nil {
+			break
+		}
+	}
+	return decisions
+}
+
+// GCRAStore is implemented by stores that support BucketGCRA. The parameters mean the
+// same as for the token bucket methods of DecisionStore.
+type GCRAStore interface {
+	CheckGCRA(ctx context.Context, key string, capacity, tokensPerInterval int, refillRate time.Duration, cost int) Decision
+	ChargeGCRA(ctx context.Context, key string, capacity, tokensPerInterval int, refillRate time.Duration, cost int) error
+}
+
+// Decision is the outcome of one rate limit check
+type Decision struct {
+	// Allowed reports whether the request's cost was consumed
+	Allowed bool
+	// Quota is the key's budget after the check: Limit, Remaining, ResetAt and RetryAfter
+	Quota
+	// Algorithm is AlgorithmSlidingWindow, AlgorithmSlidingWindowCounter, AlgorithmTokenBucket or AlgorithmGCRA
+	Algorithm string
+	// Err is set when the state couldn't be read or written (e.g. Redis is down),
+	// Allowed must then be ignored and the middleware applies Config.FailMode
+	Err error
+}
+
+// RateLimiterStore is the original, context-free store interface. MemoryStore and RedisStore
+// still implement it, and stores written against it can be passed to the middleware with AdaptStore.
+// The Quota returned with a decision describes the key's budget after the call.
+//
+// A non-nil error means the state couldn't be read or written and the bool must be ignored.
+// The Debit methods always consume, like DecisionStore's Charge methods.
 type RateLimiterStore interface {
-	AllowedSlidingWindow(ip string, window int64, limit int) bool
-	AllowedTokenBucket(ip string, capacity, tokensPerInterval int, refillRate time.Duration) bool
+	AllowedSlidingWindow(key string, window time.Duration, limit, cost int) (bool, Quota, error)
+	AllowedTokenBucket(key string, capacity, tokensPerInterval int, refillRate time.Duration, cost int) (bool, Quota, error)
+	DebitSlidingWindow(key string, window time.Duration, limit, cost int) error
+	DebitTokenBucket(key string, capacity, tokensPerInterval int, refillRate time.Duration, cost int) error
+}
+
+// Quota is the state of one key's budget as seen by a store call
+type Quota struct {
+	// Limit is the bucket capacity or the window limit
+	Limit int
+	// Remaining is the tokens in the bucket or free slots in the window, never below zero
+	Remaining int
+	// ResetAt is when the budget will be back to Limit if no more requests arrive,
+	// zero if it never refills (e.g. a token bucket without refill)
+	ResetAt time.Time
+	// RetryAfter is how long a denied request has to wait until its cost fits,
+	// zero for allowed requests or when it is unknown
+	RetryAfter time.Duration
+}
+
+// AdaptStore wraps a RateLimiterStore so it can be used where a DecisionStore is expected.
+// The legacy methods take no context, so cancellation and deadlines are not passed down.
+func AdaptStore(store RateLimiterStore) DecisionStore {
+	return legacyStore{store: store}
+}
+
+type legacyStore struct {
+	store RateLimiterStore
+}
+
+func (l legacyStore) CheckSlidingWindow(ctx context.Context, key string, window time.Duration, limit, cost int) Decision {
+	allowed, quota, err := l.store.AllowedSlidingWindow(key, window, limit, cost)
+	return Decision{Allowed: allowed, Quota: quota, Algorithm: AlgorithmSlidingWindow, Err: err}
+}
+
+func (l legacyStore) CheckTokenBucket(ctx context.Context, key string, capacity, tokensPerInterval int, refillRate time.Duration, cost int) Decision {
+	allowed, quota, err := l.store.AllowedTokenBucket(key, capacity, tokensPerInterval, refillRate, cost)
+	return Decision{Allowed: allowed, Quota: quota, Algorithm: AlgorithmTokenBucket, Err: err}
+}
+
+func (l legacyStore) ChargeSlidingWindow(ctx context.Context, key string, window time.Duration, limit, cost int) error {
+	return l.store.DebitSlidingWindow(key, window, limit, cost)
+}
+
+func (l legacyStore) ChargeTokenBucket(ctx context.Context, key string, capacity, tokensPerInterval int, refillRate time.Duration, cost int) error {
+	return l.store.DebitTokenBucket(key, capacity, tokensPerInterval, refillRate, cost)
 }
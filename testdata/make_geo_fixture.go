@@ -0,0 +1,157 @@
+//go:build ignore
+
+// make_geo_fixture writes testdata/geo-fixture.mmdb, a tiny MaxMind-format city database
+// for the geo velocity tests: a few documentation and benchmark networks placed in cities.
+//
+//	go run testdata/make_geo_fixture.go
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"math"
+	"net/netip"
+	"os"
+	"sort"
+)
+
+type city struct {
+	network             string
+	name                string
+	latitude, longitude float64
+	noLocation          bool
+}
+
+var cities = []city{
+	{network: "192.0.2.0/24", name: "New York", latitude: 40.7128, longitude: -74.0060},
+	{network: "198.51.100.0/24", name: "London", latitude: 51.5074, longitude: -0.1278},
+	{network: "198.18.0.0/24", name: "Paris", latitude: 48.8566, longitude: 2.3522},
+	{network: "203.0.113.0/24", name: "Sydney", latitude: -33.8688, longitude: 151.2093},
+	// a network known without coordinates, like country-only records
+	{network: "198.19.0.0/24", name: "Nowhere", noLocation: true},
+}
+
+// record is one 24 bit pointer of a search tree node: a node, empty or data
+type record struct {
+	node int // index of the child node, -1 for none
+	data int // offset in the data section, -1 for none
+}
+
+func main() {
+	var data bytes.Buffer
+	nodes := [][2]record{{{-1, -1}, {-1, -1}}}
+
+	for _, c := range cities {
+		prefix := netip.MustParsePrefix(c.network)
+		offset := data.Len()
+		location := map[string]any{
+			"city": map[string]any{"names": map[string]any{"en": c.name}},
+		}
+		if !c.noLocation {
+			location["location"] = map[string]any{"latitude": c.latitude, "longitude": c.longitude}
+		}
+		encode(&data, location)
+
+		addr := prefix.Addr().As4()
+		node := 0
+		for i := 0; i < prefix.Bits(); i++ {
+			bit := addr[i/8] >> (7 - i%8) & 1
+			if i == prefix.Bits()-1 {
+				nodes[node][bit] = record{node: -1, data: offset}
+				break
+			}
+			if nodes[node][bit].node < 0 {
+				nodes = append(nodes, [2]record{{-1, -1}, {-1, -1}})
+				nodes[node][bit] = record{node: len(nodes) - 1, data: -1}
+			}
+			node = nodes[node][bit].node
+		}
+	}
+
+	var out bytes.Buffer
+	count := len(nodes)
+	for _, n := range nodes {
+		for _, r := range n {
+			value := count // empty
+			switch {
+			case r.node >= 0:
+				value = r.node
+			case r.data >= 0:
+				value = count + 16 + r.data
+			}
+			out.Write([]byte{byte(value >> 16), byte(value >> 8), byte(value)})
+		}
+	}
+	out.Write(make([]byte, 16))
+	out.Write(data.Bytes())
+	out.WriteString("\xab\xcd\xefMaxMind.com")
+	encode(&out, map[string]any{
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(1767225600),
+		"database_type":               "ankyloGo-Test-City",
+		"description":                 map[string]any{"en": "ankyloGo test fixture"},
+		"ip_version":                  uint16(4),
+		"languages":                   []any{"en"},
+		"node_count":                  uint32(count),
+		"record_size":                 uint16(24),
+	})
+
+	if err := os.WriteFile("testdata/geo-fixture.mmdb", out.Bytes(), 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// encode writes value in the MaxMind DB data format
+func encode(w *bytes.Buffer, value any) {
+	switch v := value.(type) {
+	case string:
+		control(w, 2, len(v))
+		w.WriteString(v)
+	case float64:
+		control(w, 3, 8)
+		binary.Write(w, binary.BigEndian, math.Float64bits(v))
+	case uint16:
+		control(w, 5, 2)
+		binary.Write(w, binary.BigEndian, v)
+	case uint32:
+		control(w, 6, 4)
+		binary.Write(w, binary.BigEndian, v)
+	case uint64:
+		control(w, 9, 8)
+		binary.Write(w, binary.BigEndian, v)
+	case []any:
+		control(w, 11, len(v))
+		for _, item := range v {
+			encode(w, item)
+		}
+	case map[string]any:
+		control(w, 7, len(v))
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			encode(w, key)
+			encode(w, v[key])
+		}
+	default:
+		log.Fatalf("cannot encode %T", value)
+	}
+}
+
+// control writes the control byte of a field of kind and size, size below 29
+func control(w *bytes.Buffer, kind, size int) {
+	if size >= 29 {
+		log.Fatalf("field of %d bytes is too long for this writer", size)
+	}
+	if kind <= 7 {
+		w.WriteByte(byte(kind<<5 | size))
+		return
+	}
+	// extended types: kind 0 in the control byte, kind-7 in the next one
+	w.WriteByte(byte(size))
+	w.WriteByte(byte(kind - 7))
+}
@@ -2,58 +2,183 @@ package ankylogo
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// The following code block implements the Token Bucket Algoritm
+// The following code block implements the Token Bucket Algoritm.
+// Tokens are refilled on whole intervals of a grid starting when the bucket is created.
+// Instead of a balance and a last refill time the bucket keeps a single number, its debt:
+// at interval n it holds min(capacity, n*tokensPerInterval - debt) tokens. Taking tokens
+// only swaps the debt with compare-and-swap, so requests never wait on each other
 type TokenBucket struct {
-	tokens            int
-	capacity          int
+	debt              atomic.Int64
+	capacity          atomic.Int64
 	tokensPerInterval int
 	refillRate        time.Duration
-	lastRefill        time.Time
-	mu                sync.Mutex // handling race conditions (two processes trying to access tokens simultaneously)
+	start             time.Time    // origin of the refill interval grid
+	mu                sync.RWMutex // held for writing only to change the refill, which changes what debt means
 }
 
 func NewTokenBucket(capacity, tokensPerInterval int, refillRate time.Duration) *TokenBucket {
-	return &TokenBucket{
-		capacity:          capacity,
-		tokens:            capacity,
+	tb := &TokenBucket{
 		tokensPerInterval: tokensPerInterval,
 		refillRate:        refillRate,
-		lastRefill:        time.Now(),
+		start:             time.Now(),
 	}
+	tb.capacity.Store(int64(capacity))
+	// nothing earned yet, a debt of -capacity leaves the bucket full
+	tb.debt.Store(-int64(capacity))
+	return tb
 }
 
-func (tb *TokenBucket) TakeTokens() bool {
-	// handle race conditions
+// TakeTokens removes count tokens from the bucket if they are all available
+// and returns the state of the bucket afterwards.
+// A request is never partially charged: either every token is taken or none.
+func (tb *TokenBucket) TakeTokens(count int) (bool, Quota) {
+	tb.mu.RLock()
+	defer tb.mu.RUnlock()
+
+	for {
+		now := time.Now()
+		debt := tb.debt.Load()
+		interval, earned := tb.earned(now)
+		capacity := tb.capacity.Load()
+		tokens := min(capacity, earned-debt)
+		// if there are not enough tokens available in the bucket, this request won't go through
+		if tokens < int64(count) {
+			return false, tb.quota(now, interval, tokens, capacity, count)
+		}
+		if tb.debt.CompareAndSwap(debt, earned-tokens+int64(count)) {
+			return true, tb.quota(now, interval, tokens-int64(count), capacity, 0)
+		}
+	}
+}
+
+// DebitTokens removes count tokens unconditionally. The balance may go negative,
+// in which case the bucket has to refill past zero before the next request passes.
+func (tb *TokenBucket) DebitTokens(count int) {
+	tb.mu.RLock()
+	defer tb.mu.RUnlock()
+
+	for {
+		debt := tb.debt.Load()
+		_, earned := tb.earned(time.Now())
+		tokens := min(tb.capacity.Load(), earned-debt)
+		if tb.debt.CompareAndSwap(debt, earned-tokens+int64(count)) {
+			return
+		}
+	}
+}
+
+// earned returns the refill interval now falls in and the tokens earned up to it,
+// caller must hold tb.mu
+func (tb *TokenBucket) earned(now time.Time) (interval, tokens int64) {
+	if tb.refillRate <= 0 || tb.tokensPerInterval <= 0 {
+		return 0, 0
+	}
+	interval = int64(now.Sub(tb.start) / tb.refillRate)
+	return interval, interval * int64(tb.tokensPerInterval)
+}
+
+// tokens returns the interval now falls in, the tokens held and the capacity, caller must hold tb.mu
+func (tb *TokenBucket) tokens(now time.Time) (interval, tokens, capacity int64) {
+	debt := tb.debt.Load()
+	interval, earned := tb.earned(now)
+	capacity = tb.capacity.Load()
+	return interval, min(capacity, earned-debt), capacity
+}
+
+// configure applies the parameters of the current request. Tokens earned so far are kept,
+// up to the new capacity, so lowering the capacity takes effect immediately
+func (tb *TokenBucket) configure(capacity, tokensPerInterval int, refillRate time.Duration) {
+	// the capacity only caps the tokens held, the debt means the same under any capacity
+	tb.capacity.Store(int64(capacity))
+
+	tb.mu.RLock()
+	unchanged := tokensPerInterval == tb.tokensPerInterval && refillRate == tb.refillRate
+	tb.mu.RUnlock()
+	if unchanged {
+		return
+	}
+
 	tb.mu.Lock()
 	defer tb.mu.Unlock()
 
-	// calculate how many tokens to refill based on elapsed time
 	now := time.Now()
-	elapsed := now.Sub(tb.lastRefill)
-
+	interval, tokens, _ := tb.tokens(now)
 	if tb.refillRate > 0 && tb.tokensPerInterval > 0 {
-		// how many refill intervals have passed since the last refill
-		intervals := int(elapsed / tb.refillRate)
-		if intervals > 0 {
-			tb.tokens += intervals * tb.tokensPerInterval
-			// cap tokens at capacity
-			if tb.tokens > tb.capacity {
-				tb.tokens = tb.capacity
-			}
-			tb.lastRefill = now
-		}
+		// keep the unused part of the current interval
+		tb.start = tb.start.Add(time.Duration(interval) * tb.refillRate)
+	} else {
+		// the bucket did not refill so far, start counting intervals now
+		tb.start = now
+	}
+	tb.tokensPerInterval = tokensPerInterval
+	tb.refillRate = refillRate
+	_, earned := tb.earned(now)
+	tb.debt.Store(earned - tokens)
+}
+
+// peek reports whether count tokens are available and the state of the bucket, without taking them
+func (tb *TokenBucket) peek(count int) (bool, Quota) {
+	tb.mu.RLock()
+	defer tb.mu.RUnlock()
+
+	now := time.Now()
+	interval, tokens, capacity := tb.tokens(now)
+	if tokens >= int64(count) {
+		return true, tb.quota(now, interval, tokens, capacity, 0)
+	}
+	return false, tb.quota(now, interval, tokens, capacity, count)
+}
+
+func (tb *TokenBucket) take(count int) (bool, Quota) {
+	return tb.TakeTokens(count)
+}
+
+// refund puts back count tokens taken by a request that was denied elsewhere,
+// the bucket still holds no more than its capacity
+func (tb *TokenBucket) refund(count int) {
+	tb.mu.RLock()
+	defer tb.mu.RUnlock()
+
+	tb.debt.Add(-int64(count))
+}
+
+// recoveredAt is when the bucket is full again, never if it is short of tokens and does not refill
+func (tb *TokenBucket) recoveredAt() (time.Time, bool) {
+	tb.mu.RLock()
+	defer tb.mu.RUnlock()
+
+	now := time.Now()
+	interval, tokens, capacity := tb.tokens(now)
+	if tokens >= capacity {
+		return tb.start.Add(time.Duration(interval) * tb.refillRate), true
+	}
+	if tb.refillRate <= 0 || tb.tokensPerInterval <= 0 {
+		return time.Time{}, false
 	}
+	return tb.quota(now, interval, tokens, capacity, 0).ResetAt, true
+}
 
-	// if there are tokens available in the bucket, we take one out
-	// in this case request goes through, thus we return true.
-	if tb.tokens > 0 {
-		tb.tokens--
-		return true
+// quota describes the bucket for a response, caller must hold tb.mu.
+// needed is the cost of a denied request, used to work out when it would fit
+func (tb *TokenBucket) quota(now time.Time, interval, tokens, capacity int64, needed int) Quota {
+	q := Quota{Limit: int(capacity), Remaining: int(max(tokens, 0))}
+	if tb.refillRate <= 0 || tb.tokensPerInterval <= 0 {
+		return q
+	}
+	// time at which the bucket holds n tokens, refills happen on whole intervals of the grid
+	lastRefill := tb.start.Add(time.Duration(interval) * tb.refillRate)
+	tokensAt := func(n int64) time.Time {
+		missing := max(n-tokens, 0)
+		intervals := (missing + int64(tb.tokensPerInterval) - 1) / int64(tb.tokensPerInterval)
+		return lastRefill.Add(time.Duration(intervals) * tb.refillRate)
+	}
+	q.ResetAt = tokensAt(capacity)
+	if needed > 0 && int64(needed) <= capacity {
+		q.RetryAfter = max(tokensAt(int64(needed)).Sub(now), 0)
 	}
-	// in the case where tokens are unavailable, this request won't
-	// go through, so we return false
-	return false
+	return q
 }
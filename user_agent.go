@@ -0,0 +1,74 @@
+package ankylogo
+
+import (
+	"strings"
+	"time"
+)
+
+// DefaultBadUserAgents are fragments of the User-Agent of common attack and scraping tools
+var DefaultBadUserAgents = []string{
+	"sqlmap", "nikto", "nmap", "masscan", "zgrab", "nuclei",
+	"gobuster", "dirbuster", "wpscan", "hydra", "scrapy",
+}
+
+// UserAgentChurnDetector flags actors that keep changing their User-Agent,
+// typical of bots rotating through a list to look like many browsers.
+// Distinct user agents are counted with a HyperLogLog sketch, a few hundred bytes per
+// actor however many agents it rotates through. Requests without a User-Agent give
+// half a signal, requests from a known-bad one a full signal
+type UserAgentChurnDetector struct {
+	// Window is how far back user agents count (0 = 10 minutes).
+	// The sketch rolls over in halves, so an agent counts for between half a Window and a Window
+	Window time.Duration
+	// Threshold is the number of distinct user agents within Window that gives a full signal (0 = 5).
+	// A single user agent gives none
+	Threshold int
+	// BadAgents are fragments marking a known-bad User-Agent, matched ignoring case
+	// (nil = DefaultBadUserAgents)
+	BadAgents []string
+
+	actors actorStates[rollingSketch]
+}
+
+func (d *UserAgentChurnDetector) Name() string {
+	return "ua_churn"
+}
+
+func (d *UserAgentChurnDetector) Observe(actor string, event RateLimitEvent) float64 {
+	window := d.Window
+	if window <= 0 {
+		window = 10 * time.Minute
+	}
+	threshold := d.Threshold
+	if threshold <= 0 {
+		threshold = 5
+	}
+
+	now := eventTime(event)
+	distinct := d.actors.update(actor, now, window, func(agents *rollingSketch) float64 {
+		return agents.add(event.UserAgent, now, window)
+	})
+
+	signal := ramp(distinct, 1, float64(threshold))
+	if event.UserAgent == "" {
+		signal = max(signal, 0.5)
+	} else if d.isBad(event.UserAgent) {
+		signal = 1
+	}
+	return signal
+}
+
+// isBad reports whether userAgent contains one of the known-bad fragments
+func (d *UserAgentChurnDetector) isBad(userAgent string) bool {
+	bad := d.BadAgents
+	if bad == nil {
+		bad = DefaultBadUserAgents
+	}
+	userAgent = strings.ToLower(userAgent)
+	for _, fragment := range bad {
+		if fragment != "" && strings.Contains(userAgent, strings.ToLower(fragment)) {
+			return true
+		}
+	}
+	return false
+}